@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/registry/client/auth"
+	clienttransport "github.com/docker/distribution/registry/client/transport"
+)
+
+// credentials implements auth.CredentialStore for the user given on the
+// command line or found in the docker config.
+type credentials struct {
+	username      string
+	password      string
+	identityToken string
+	mu            sync.Mutex
+	refreshTokens map[string]string
+}
+
+func (c *credentials) Basic(*url.URL) (string, string) {
+	return c.username, c.password
+}
+
+func (c *credentials) RefreshToken(u *url.URL, service string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.refreshTokens[service]; ok {
+		return t
+	}
+	return c.identityToken
+}
+
+func (c *credentials) SetRefreshToken(u *url.URL, service, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshTokens[service] = token
+}
+
+// registryScope is a token scope for registry wide resources like the
+// catalog, the vendored auth package only knows about repository scopes.
+type registryScope struct {
+	name    string
+	actions []string
+}
+
+func (s registryScope) String() string {
+	return fmt.Sprintf("registry:%s:%s", s.name, strings.Join(s.actions, ","))
+}
+
+type registryAuth struct {
+	base       http.RoundTripper
+	challenges auth.ChallengeManager
+	creds      *credentials
+	// push is needed to untag, the tags are overwritten with placeholders
+	push bool
+}
+
+// newRegistryAuth pings the registry to find out which authentication
+// schemes it supports.
+func newRegistryAuth(registryURL string, base http.RoundTripper, username, password, identityToken string) (*registryAuth, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/v2/"
+	resp, err := (&http.Client{Transport: base}).Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("cannot ping registry: %s", err)
+	}
+	defer resp.Body.Close()
+	cm := auth.NewSimpleChallengeManager()
+	if err := cm.AddResponse(resp); err != nil {
+		return nil, err
+	}
+	return &registryAuth{
+		base:       base,
+		challenges: cm,
+		creds: &credentials{
+			username:      username,
+			password:      password,
+			identityToken: identityToken,
+			refreshTokens: make(map[string]string),
+		},
+	}, nil
+}
+
+func (a *registryAuth) transport(scope auth.Scope) http.RoundTripper {
+	th := auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+		Transport:   a.base,
+		Credentials: a.creds,
+		Scopes:      []auth.Scope{scope},
+	})
+	bh := auth.NewBasicHandler(a.creds)
+	return clienttransport.NewTransport(a.base, auth.NewAuthorizer(a.challenges, th, bh))
+}
+
+func (a *registryAuth) catalogTransport() http.RoundTripper {
+	return a.transport(registryScope{name: "catalog", actions: []string{"*"}})
+}
+
+func (a *registryAuth) repositoryTransport(name string) http.RoundTripper {
+	actions := []string{"pull", "delete"}
+	if a.push {
+		actions = []string{"pull", "push", "delete"}
+	}
+	return a.transport(auth.RepositoryScope{Repository: name, Actions: actions})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// tokenRegistry stands in for a registry behind a token server, it records
+// the scopes requested from the token endpoint.
+type tokenRegistry struct {
+	*httptest.Server
+	mu     sync.Mutex
+	scopes []string
+}
+
+func newTokenRegistry() *tokenRegistry {
+	tr := &tokenRegistry{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		tr.scopes = append(tr.scopes, r.URL.Query()["scope"]...)
+		tr.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"token":"secret-token"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, tr.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	})
+	tr.Server = httptest.NewServer(mux)
+	return tr
+}
+
+func (tr *tokenRegistry) requestedScopes() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	s := tr.scopes
+	tr.scopes = nil
+	return s
+}
+
+func get(t *testing.T, rt http.RoundTripper, url string) {
+	resp, err := (&http.Client{Transport: rt}).Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned %d", url, resp.StatusCode)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	srv := newTokenRegistry()
+	defer srv.Close()
+
+	ra, err := newRegistryAuth(srv.URL, http.DefaultTransport, "", "", "")
+	if err != nil {
+		t.Fatalf("cannot ping registry: %s", err)
+	}
+	tests := []struct {
+		name  string
+		push  bool
+		rt    func() http.RoundTripper
+		path  string
+		scope string
+	}{
+		{"catalog", false, ra.catalogTransport, "/v2/_catalog", "registry:catalog:*"},
+		{"repository", false, func() http.RoundTripper { return ra.repositoryTransport("foo") }, "/v2/foo/tags/list", "repository:foo:pull,delete"},
+		{"repository untag", true, func() http.RoundTripper { return ra.repositoryTransport("foo") }, "/v2/foo/tags/list", "repository:foo:pull,push,delete"},
+	}
+	for _, tc := range tests {
+		ra.push = tc.push
+		get(t, tc.rt(), srv.URL+tc.path)
+		scopes := srv.requestedScopes()
+		if len(scopes) != 1 || scopes[0] != tc.scope {
+			t.Errorf("%s: requested scopes %v, expected %s", tc.name, scopes, tc.scope)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	ra, err := newRegistryAuth(srv.URL, http.DefaultTransport, "user", "secret", "")
+	if err != nil {
+		t.Fatalf("cannot ping registry: %s", err)
+	}
+	get(t, ra.catalogTransport(), srv.URL+"/v2/_catalog")
+	get(t, ra.repositoryTransport("foo"), srv.URL+"/v2/foo/tags/list")
+
+	ra, err = newRegistryAuth(srv.URL, http.DefaultTransport, "user", "wrong", "")
+	if err != nil {
+		t.Fatalf("cannot ping registry: %s", err)
+	}
+	resp, err := (&http.Client{Transport: ra.catalogTransport()}).Get(srv.URL + "/v2/_catalog")
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password returned %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/digest"
+)
+
+// cache is a content addressed on-disk cache of image infos. A digest always
+// names the same manifest, so entries never have to be invalidated.
+type cache struct {
+	dir    string
+	hits   int64
+	misses int64
+}
+
+func newCache(dir string) (*cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cache{dir: dir}, nil
+}
+
+func (c *cache) path(dig digest.Digest) string {
+	hex := dig.Hex()
+	prefix := hex
+	if len(hex) > 2 {
+		prefix = hex[:2]
+	}
+	return filepath.Join(c.dir, string(dig.Algorithm()), prefix, hex+".json")
+}
+
+// get returns nil when the digest is not cached; a nil cache never hits.
+func (c *cache) get(dig digest.Digest) *imageInfo {
+	if c == nil || dig.Validate() != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.path(dig))
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil
+	}
+	var ii imageInfo
+	if err := json.Unmarshal(data, &ii); err != nil {
+		log.WithFields(log.Fields{
+			"digest": dig,
+			"error":  err,
+		}).Warn("ignoring broken cache entry")
+		atomic.AddInt64(&c.misses, 1)
+		return nil
+	}
+	if ii.Version != imageInfoVersion {
+		atomic.AddInt64(&c.misses, 1)
+		return nil
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return &ii
+}
+
+func (c *cache) put(dig digest.Digest, ii *imageInfo) {
+	if c == nil || dig.Validate() != nil {
+		return
+	}
+	if err := c.write(c.path(dig), ii); err != nil {
+		log.WithFields(log.Fields{
+			"digest": dig,
+			"error":  err,
+		}).Warn("cannot write cache entry")
+	}
+}
+
+// write stores the entry atomically, so concurrent readers never see a
+// partial entry.
+func (c *cache) write(fname string, ii *imageInfo) error {
+	data, err := json.Marshal(ii)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, data)
+}
+
+// writeFileAtomic writes a temporary file next to fname first and renames it,
+// so the file is either complete or not touched at all.
+func writeFileAtomic(fname string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// deleteDangling deletes the manifest revisions which are neither tagged nor
+// part of a tagged manifest list. They are invisible to the API, but keep
+// their layers alive through the garbage collection. Revisions which were
+// pushed less than minAge ago are left alone together with their children,
+// they may belong to a push in progress.
+func (s *offlineStorage) deleteDangling(ctx context.Context, minAge time.Duration, sum *summary) {
+	enum, ok := s.ns.(distribution.RepositoryEnumerator)
+	if !ok {
+		sum.fail("(dangling)", fmt.Errorf("storage cannot enumerate repositories"))
+		return
+	}
+	var repos []string
+	err := enum.Enumerate(ctx, func(name string) error {
+		repos = append(repos, name)
+		return nil
+	})
+	if err != nil {
+		sum.fail("(dangling)", err)
+		return
+	}
+	sum.dangling = 0
+	oldest := time.Now().Add(-minAge)
+	for _, name := range repos {
+		n, err := s.deleteDanglingManifests(ctx, name, oldest)
+		sum.dangling += n
+		if err != nil {
+			sum.fail(name, err)
+		}
+	}
+}
+
+func (s *offlineStorage) deleteDanglingManifests(ctx context.Context, name string, oldest time.Time) (int, error) {
+	r, err := s.repository(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	enum, ok := r.manifests.(distribution.ManifestEnumerator)
+	if !ok {
+		return 0, fmt.Errorf("storage cannot enumerate manifests")
+	}
+	referenced, err := r.referencedManifests()
+	if err != nil {
+		return 0, err
+	}
+	var dangling []digest.Digest
+	err = enum.Enumerate(ctx, func(d digest.Digest) error {
+		if !referenced[d] {
+			dangling = append(dangling, d)
+		}
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// the children of young manifest lists belong to a push in progress as
+	// well, they are marked before anything is deleted
+	var old []digest.Digest
+	for _, d := range dangling {
+		fi, err := s.driver.Stat(ctx, revisionLink(name, d))
+		if err != nil {
+			return 0, err
+		}
+		if !fi.ModTime().After(oldest) {
+			old = append(old, d)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"repository": name,
+			"digest":     d,
+			"pushed":     fi.ModTime(),
+		}).Info("keep dangling manifest, it is too young")
+		children, err := r.listChildren(distribution.Descriptor{Digest: d})
+		if err != nil {
+			return 0, fmt.Errorf("cannot query manifest %s: %s", d, err)
+		}
+		for _, c := range children {
+			referenced[c] = true
+		}
+	}
+
+	failed, deleted := 0, 0
+	for _, d := range old {
+		if referenced[d] {
+			log.WithFields(log.Fields{
+				"repository": name,
+				"digest":     d,
+			}).Info("keep dangling manifest, it is part of a young manifest list")
+			continue
+		}
+		b := blobinfo{repo: name, digest: d}
+		e := r.deleteDigest(d, nil)
+		switch {
+		case e != nil:
+			cleanupReport.add(b, decisionError, "delete of dangling manifest failed", e)
+			failed++
+			continue
+		case *dry:
+			cleanupReport.add(b, decisionSkipped, "dry run, would delete dangling manifest", nil)
+		default:
+			cleanupReport.add(b, decisionDeleted, "dangling manifest", nil)
+		}
+		deleted++
+	}
+	log.WithFields(log.Fields{
+		"repository": name,
+		"dangling":   len(dangling),
+		"deleted":    deleted,
+	}).Info("dangling manifests")
+	if failed > 0 {
+		return deleted, fmt.Errorf("%d deletions of dangling manifests failed", failed)
+	}
+	return deleted, nil
+}
+
+// referencedManifests returns the tagged manifests and the children of
+// tagged manifest lists. A tagged manifest which cannot be read fails the
+// repository, its children would be unknown otherwise.
+func (r *repository) referencedManifests() (map[digest.Digest]bool, error) {
+	referenced := make(map[digest.Digest]bool)
+	all, err := r.tags.All(r.ctx)
+	if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+		return referenced, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mark func(d digest.Digest) error
+	mark = func(d digest.Digest) error {
+		if referenced[d] {
+			return nil
+		}
+		referenced[d] = true
+		mf, err := r.manifests.Get(r.ctx, d)
+		if err != nil {
+			return fmt.Errorf("cannot query manifest %s: %s", d, err)
+		}
+		if ml, ok := mf.(*manifestlist.DeserializedManifestList); ok {
+			for _, m := range ml.Manifests {
+				if err := mark(m.Digest); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, t := range all {
+		desc, err := r.tags.Get(r.ctx, t)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query tag %s: %s", t, err)
+		}
+		if err := mark(desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
+
+func revisionLink(name string, d digest.Digest) string {
+	return path.Join(repositoriesRoot, name, "_manifests", "revisions", string(d.Algorithm()), d.Hex(), "link")
+}
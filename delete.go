@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+)
+
+// deleteAll applies the planned deletions of a repository. The planned
+// children of deleted manifest lists are deleted afterwards, unless a list
+// using them could not be deleted.
+func (r *repository) deleteAll(blobs []blobinfo, dels []deletion) error {
+	failed := 0
+	deleted := make(map[digest.Digest]bool)
+	byTag := make(map[string]blobinfo)
+	for _, b := range blobs {
+		byTag[b.tag] = b
+	}
+	for _, d := range dels {
+		if d.child {
+			continue
+		}
+		if d.untag {
+			for _, t := range d.tags {
+				if *dry {
+					log.WithFields(log.Fields{
+						"repo": r.reponame,
+						"tag":  t,
+					}).Info("DRY UNTAG")
+					cleanupReport.add(byTag[t], decisionSkipped, "dry run, would untag", nil)
+					continue
+				}
+				e := r.untag(t)
+				if e != nil {
+					log.WithFields(log.Fields{
+						"tag":   t,
+						"error": e,
+					}).Error("error untagging")
+					cleanupReport.add(byTag[t], decisionError, "untag failed", e)
+					failed++
+					continue
+				}
+				cleanupReport.add(byTag[t], decisionDeleted, "untagged, digest is still referenced", nil)
+			}
+			continue
+		}
+		e := r.deleteDigest(d.digest, d.tags)
+		for _, t := range d.tags {
+			switch {
+			case e != nil:
+				cleanupReport.add(byTag[t], decisionError, "delete failed", e)
+			case *dry:
+				cleanupReport.add(byTag[t], decisionSkipped, "dry run, would delete", nil)
+			default:
+				cleanupReport.add(byTag[t], decisionDeleted, "expired", nil)
+			}
+		}
+		if e != nil {
+			failed++
+			continue
+		}
+		deleted[d.digest] = true
+	}
+
+	unreferenced := make(map[digest.Digest]bool)
+	for _, c := range planCascade(blobs, deleted) {
+		unreferenced[c] = true
+	}
+	for _, d := range dels {
+		if !d.child {
+			continue
+		}
+		if !unreferenced[d.digest] {
+			log.WithFields(log.Fields{
+				"repo":   r.reponame,
+				"digest": d.digest,
+			}).Warn("child of manifest list is still referenced, not deleting")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"repo":   r.reponame,
+			"digest": d.digest,
+		}).Info("child of deleted manifest list is no longer referenced")
+		if r.deleteDigest(d.digest, nil) != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d deletions failed", failed)
+	}
+	return nil
+}
+
+func (r *repository) deleteDigest(dig digest.Digest, tags []string) error {
+	if *dry {
+		log.WithFields(log.Fields{
+			"repo":   r.reponame,
+			"digest": dig,
+			"tags":   tags,
+		}).Info("DRY DELETE")
+		return nil
+	}
+	e := r.removeTags(dig)
+	if e == nil {
+		e = r.manifests.Delete(r.ctx, dig)
+	}
+	if e != nil {
+		log.WithFields(log.Fields{
+			"digest": dig,
+			"error":  e,
+		}).Error("error deleting digest")
+	}
+	return e
+}
+
+// removeTags untags all tags of a digest before it is deleted from the
+// storage. The registry API does this itself, the storage only removes the
+// manifest revision and would leave dangling tags.
+func (r *repository) removeTags(dig digest.Digest) error {
+	if !r.offline {
+		return nil
+	}
+	tags, err := r.tags.Lookup(r.ctx, distribution.Descriptor{Digest: dig})
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if err := r.tags.Untag(r.ctx, t); err != nil {
+			return fmt.Errorf("cannot untag %s: %s", t, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const passwordEnv = "REGISTRY_CLEANER_PASSWORD"
+
+// identityTokenUser is the username docker uses for entries whose secret is
+// an identity (refresh) token instead of a password.
+const identityTokenUser = "<token>"
+
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func defaultDockerConfig() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// registryHost strips scheme and path from the keys used in the docker
+// config, so "https://my.registry:5000/v1/" becomes "my.registry:5000".
+func registryHost(s string) string {
+	if strings.Contains(s, "://") {
+		if u, err := url.Parse(s); err == nil {
+			return u.Host
+		}
+	}
+	return strings.SplitN(s, "/", 2)[0]
+}
+
+// resolveCredentials returns username, password and identity token for the
+// registry. A password given on stdin, in the environment or with -password
+// wins, otherwise the docker config and its credential helpers are asked. A
+// password without -user is refused instead of being ignored.
+func resolveCredentials(registryURL string) (string, string, string, error) {
+	pw := *password
+	if e := os.Getenv(passwordEnv); e != "" {
+		pw = e
+	}
+	if *passwordStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", "", "", fmt.Errorf("cannot read password from stdin: %s", err)
+		}
+		pw = strings.TrimRight(line, "\r\n")
+	}
+	if *user != "" {
+		return *user, pw, "", nil
+	}
+	if pw != "" {
+		return "", "", "", fmt.Errorf("a password was given without -user")
+	}
+
+	fname := *dockerConfigFile
+	if fname == "" {
+		fname = defaultDockerConfig()
+		if _, err := os.Stat(fname); fname == "" || os.IsNotExist(err) {
+			return "", "", "", nil
+		}
+	}
+	return dockerCredentials(fname, registryHost(registryURL))
+}
+
+func dockerCredentials(fname, host string) (string, string, string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", "", "", err
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", "", "", fmt.Errorf("cannot parse docker config %s: %s", fname, err)
+	}
+
+	helper := cfg.CredsStore
+	if h, ok := cfg.CredHelpers[host]; ok {
+		helper = h
+	}
+	if helper != "" {
+		log.WithFields(log.Fields{
+			"helper": helper,
+			"host":   host,
+		}).Info("query credential helper")
+		c, err := credentialHelper(helper, host)
+		if err != nil {
+			return "", "", "", err
+		}
+		if c.Username == identityTokenUser {
+			return "", "", c.Secret, nil
+		}
+		return c.Username, c.Secret, "", nil
+	}
+
+	for k, a := range cfg.Auths {
+		if registryHost(k) != host {
+			continue
+		}
+		if a.Auth != "" {
+			dec, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return "", "", "", fmt.Errorf("cannot decode auth for %s: %s", k, err)
+			}
+			parts := strings.SplitN(string(dec), ":", 2)
+			if len(parts) != 2 {
+				return "", "", "", fmt.Errorf("invalid auth for %s", k)
+			}
+			a.Username, a.Password = parts[0], parts[1]
+		}
+		return a.Username, a.Password, a.IdentityToken, nil
+	}
+	return "", "", "", nil
+}
+
+func credentialHelper(helper, host string) (*helperCredentials, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(out.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return &helperCredentials{}, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %s: %s", helper, err, msg)
+	}
+	var c helperCredentials
+	if err := json.Unmarshal(out.Bytes(), &c); err != nil {
+		return nil, fmt.Errorf("cannot parse output of credential helper %s: %s", helper, err)
+	}
+	return &c, nil
+}
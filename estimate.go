@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/digest"
+)
+
+type repositoryPlan struct {
+	scan scanResult
+	dels []deletion
+}
+
+// manifestKey identifies a manifest in a repository. The same manifest in two
+// repositories references its blobs twice, the blobs are stored only once.
+type manifestKey struct {
+	repo   string
+	digest digest.Digest
+}
+
+// estimateReclaimable returns the bytes of the blobs which are referenced by
+// no manifest when the planned deletions are applied. Blobs only freed by the
+// deletions of one repository are logged for this repository. Manifests
+// without a tag are not known, so the estimate is an upper bound.
+func estimateReclaimable(plans []repositoryPlan) int64 {
+	refs := make(map[manifestKey][]blobRef)
+	deleted := make(map[manifestKey]bool)
+	for _, p := range plans {
+		for _, b := range p.scan.blobs {
+			if b.err == nil {
+				refs[manifestKey{b.repo, b.digest}] = b.blobs
+			}
+		}
+		for _, d := range p.dels {
+			if !d.untag {
+				deleted[manifestKey{p.scan.name, d.digest}] = true
+			}
+		}
+	}
+
+	sizes := make(map[digest.Digest]int64)
+	remaining := make(map[digest.Digest]int)
+	freedBy := make(map[digest.Digest]map[string]bool)
+	for k, blobs := range refs {
+		for _, b := range blobs {
+			sizes[b.Digest] = b.Size
+			if !deleted[k] {
+				remaining[b.Digest]++
+				continue
+			}
+			if freedBy[b.Digest] == nil {
+				freedBy[b.Digest] = make(map[string]bool)
+			}
+			freedBy[b.Digest][k.repo] = true
+		}
+	}
+
+	var total int64
+	perRepo := make(map[string]int64)
+	perRepoBlobs := make(map[string]int)
+	for dig, repos := range freedBy {
+		if remaining[dig] > 0 {
+			continue
+		}
+		total += sizes[dig]
+		repo := "(shared)"
+		if len(repos) == 1 {
+			for r := range repos {
+				repo = r
+			}
+		}
+		perRepo[repo] += sizes[dig]
+		perRepoBlobs[repo]++
+	}
+
+	var names []string
+	for r := range perRepo {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	for _, r := range names {
+		log.WithFields(log.Fields{
+			"repository":  r,
+			"blobs":       perRepoBlobs[r],
+			"reclaimable": humanSize(perRepo[r]),
+			"bytes":       perRepo[r],
+		}).Info("reclaimable space")
+	}
+	return total
+}
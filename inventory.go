@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type inventoryRow struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+	MediaType  string `json:"mediaType"`
+	Created    string `json:"created"`
+	Size       int64  `json:"size"`
+	Error      string `json:"error,omitempty"`
+
+	created time.Time
+}
+
+// dumpInventory writes every tag of the scanned repositories without
+// deleting anything.
+func dumpInventory(fname string, results []scanResult, sum *summary) error {
+	var rows []inventoryRow
+	for _, sr := range results {
+		if sr.err != nil {
+			sum.fail(sr.name, sr.err)
+			continue
+		}
+		if e := lookupFailures(sr.blobs); e != nil {
+			sum.fail(sr.name, e)
+		}
+		for _, b := range sr.blobs {
+			cleanupReport.add(b, decisionSkipped, "no retention configured", b.err)
+			row := inventoryRow{
+				Repository: b.repo,
+				Tag:        b.tag,
+				Digest:     string(b.digest),
+				MediaType:  b.mediaType,
+				Size:       b.size,
+				created:    b.created,
+			}
+			if !b.created.IsZero() {
+				row.Created = b.created.Format(time.RFC3339)
+			}
+			if b.err != nil {
+				row.Error = b.err.Error()
+			}
+			rows = append(rows, row)
+		}
+	}
+	sortInventory(rows, *dumpSort)
+
+	w := io.Writer(os.Stdout)
+	if fname != "-" {
+		f, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *dumpFormat {
+	case "json":
+		if rows == nil {
+			rows = []inventoryRow{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"repository", "tag", "digest", "mediatype", "created", "size", "error"})
+		for _, r := range rows {
+			cw.Write([]string{r.Repository, r.Tag, r.Digest, r.MediaType, r.Created, strconv.FormatInt(r.Size, 10), r.Error})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "REPOSITORY\tTAG\tDIGEST\tMEDIA TYPE\tCREATED\tSIZE")
+		for _, r := range rows {
+			created := r.Created
+			if r.Error != "" {
+				created = "error: " + r.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Repository, r.Tag, r.Digest, r.MediaType, created, humanSize(r.Size))
+		}
+		return tw.Flush()
+	}
+}
+
+func sortInventory(rows []inventoryRow, by string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch by {
+		case "created":
+			if !a.created.Equal(b.created) {
+				return a.created.Before(b.created)
+			}
+		case "size":
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		}
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.Tag < b.Tag
+	})
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,15 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"regexp"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -21,35 +20,66 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/client"
 
-	_ "github.com/docker/distribution/manifest/schema1"
-	_ "github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
 )
 
 type blobinfo struct {
-	repo    string
-	tag     string
-	digest  digest.Digest
-	created time.Time
+	repo      string
+	tag       string
+	digest    digest.Digest
+	mediaType string
+	created   time.Time
+	size      int64
+	keep      bool
+	rule      string
+	err       error
+	// lastPull is zero when no pull of the digest is known
+	lastPull time.Time
+	// children are the manifests of a manifest list, they are deleted
+	// together with the list
+	children []digest.Digest
+	// childrenErr is set when it is unknown whether the digest is a manifest
+	// list and which children it has
+	childrenErr error
+	blobs       []blobRef
 }
 
 type repository struct {
-	ctx           context.Context
-	repourl       string
-	reponame      string
-	repo          distribution.Repository
-	tags          distribution.TagService
-	blobs         distribution.BlobStore
-	manifests     distribution.ManifestService
-	digestConfigs map[string]interface{}
+	ctx       context.Context
+	repourl   string
+	reponame  string
+	repo      distribution.Repository
+	tags      distribution.TagService
+	blobs     distribution.BlobStore
+	manifests distribution.ManifestService
+	// offline repositories are opened on the storage of the registry
+	offline bool
 }
 
+// openFunc opens a repository, either through the registry API or on the
+// storage of the registry.
+type openFunc func(ctx context.Context, name string) (*repository, error)
+
+// catalog lists repositories; the API client and the storage both implement
+// it.
+type catalog interface {
+	Repositories(ctx dockercontext.Context, repos []string, last string) (int, error)
+}
+
+// checkErr stops the run for errors which make it impossible to process any
+// repository, like an unreachable registry or failed authentication.
 func checkErr(err error) {
 	if err != nil {
-		panic(err)
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("fatal error")
+		os.Exit(exitFatal)
 	}
 }
 
-func getAllRepos(ctx context.Context, reg client.Registry) []string {
+func getAllRepos(ctx context.Context, reg catalog) ([]string, error) {
 	var repos []string
 	last := ""
 	for {
@@ -65,18 +95,25 @@ func getAllRepos(ctx context.Context, reg client.Registry) []string {
 			if err == io.EOF {
 				break
 			}
-			panic(err)
+			return nil, err
 		}
 	}
-	return repos
+	return repos, nil
 }
 
-func getRepository(ctx context.Context, repourl, repname string) (*repository, error) {
-	name, _ := reference.ParseNamed(repname)
-	rep, err := client.NewRepository(ctx, name, repourl, transport)
+func getRepository(ctx context.Context, repourl, repname string, rt http.RoundTripper) (*repository, error) {
+	name, err := reference.ParseNamed(repname)
 	if err != nil {
 		return nil, err
 	}
+	rep, err := client.NewRepository(ctx, name, repourl, rt)
+	if err != nil {
+		return nil, err
+	}
+	return newRepository(ctx, repourl, repname, rep)
+}
+
+func newRepository(ctx context.Context, repourl, repname string, rep distribution.Repository) (*repository, error) {
 	tgs := rep.Tags(ctx)
 	blobs := rep.Blobs(ctx)
 	mfs, err := rep.Manifests(ctx)
@@ -84,210 +121,544 @@ func getRepository(ctx context.Context, repourl, repname string) (*repository, e
 		return nil, err
 	}
 	return &repository{
-		ctx:           ctx,
-		repourl:       repourl,
-		reponame:      repname,
-		repo:          rep,
-		blobs:         blobs,
-		tags:          tgs,
-		manifests:     mfs,
-		digestConfigs: make(map[string]interface{}),
+		ctx:       ctx,
+		repourl:   repourl,
+		reponame:  repname,
+		repo:      rep,
+		blobs:     blobs,
+		tags:      tgs,
+		manifests: mfs,
 	}, nil
 }
 
-func (r *repository) getCreated(dig digest.Digest) (*time.Time, error) {
+// imageInfo is what we need to know about a manifest. It never changes for
+// a digest, so it can be cached.
+type imageInfo struct {
+	// Version is increased when fields are added, older cache entries are
+	// ignored then.
+	Version   int       `json:"v"`
+	MediaType string    `json:"mediaType"`
+	Created   time.Time `json:"created"`
+	// Size is the sum of the config and layer sizes
+	Size int64 `json:"size"`
+	// Children are the manifests of a manifest list
+	Children []digest.Digest `json:"children,omitempty"`
+	// Blobs are the config and layers of the image, for manifest lists the
+	// ones of all children
+	Blobs []blobRef `json:"blobs,omitempty"`
+}
+
+const imageInfoVersion = 2
+
+type blobRef struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
 
+// getImageInfo returns the creation time and size of the image with the
+// given digest. For manifest lists the newest child wins; the children are
+// returned as well because they belong to the list.
+func (r *repository) getImageInfo(dig digest.Digest) (*imageInfo, error) {
+	if ii := digestCache.get(dig); ii != nil {
+		return ii, nil
+	}
 	mf, err := r.manifests.Get(r.ctx, dig)
 	if err != nil {
 		return nil, fmt.Errorf("cannot query manifest: %s", err)
 	}
-	_, pl, err := mf.Payload()
+	var ii *imageInfo
+	if ml, ok := mf.(*manifestlist.DeserializedManifestList); ok {
+		ii, err = r.getListInfo(dig, ml)
+	} else {
+		ii, err = r.getManifestInfo(dig, mf)
+	}
 	if err != nil {
 		return nil, err
 	}
-	plmap := make(map[string]interface{})
-	json.Unmarshal(pl, &plmap)
-	config := plmap["config"]
-	if config == nil {
-		// no config, try the first history object and use v1compatibility
-		hist := plmap["history"]
-		if hist == nil {
-			return nil, fmt.Errorf("no config and history found for digest: %s", dig)
-		}
-		h := hist.([]interface{})[0]
-		history := h.(map[string]interface{})
-		v1compat := history["v1Compatibility"]
-		if v1compat == nil {
-			return nil, fmt.Errorf("no v1Compatibility node in history object")
-		}
-		// v1compat is no a json string, parse it
-		v1comp := make(map[string]interface{})
-		json.Unmarshal([]byte(v1compat.(string)), &v1comp)
-		tm, e := time.Parse(time.RFC3339Nano, v1comp["created"].(string))
-		return &tm, e
-	}
-	cfg := plmap["config"].(map[string]interface{})
-	digs := cfg["digest"].(string)
-	pl, err = r.blobs.Get(r.ctx, digest.Digest(digs))
+	ii.MediaType, _, _ = mf.Payload()
+	digestCache.put(dig, ii)
+	return ii, nil
+}
+
+// listChildren returns the manifests of a manifest list without looking at
+// their creation time. Tags in the storage have no media type, their
+// manifest has to be fetched to find out.
+func (r *repository) listChildren(desc distribution.Descriptor) ([]digest.Digest, error) {
+	if desc.MediaType != "" && desc.MediaType != manifestlist.MediaTypeManifestList {
+		return nil, nil
+	}
+	mf, err := r.manifests.Get(r.ctx, desc.Digest)
 	if err != nil {
 		return nil, err
 	}
-	plmap = make(map[string]interface{})
-	err = json.Unmarshal(pl, &plmap)
-	tm, e := time.Parse(time.RFC3339Nano, plmap["created"].(string))
-	return &tm, e
+	ml, ok := mf.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		return nil, nil
+	}
+	var children []digest.Digest
+	for _, m := range ml.Manifests {
+		children = append(children, m.Digest)
+	}
+	return children, nil
 }
 
-func (r *repository) getBlobInfos() ([]blobinfo, error) {
-	var result []blobinfo
+func (r *repository) getListInfo(dig digest.Digest, ml *manifestlist.DeserializedManifestList) (*imageInfo, error) {
+	if len(ml.Manifests) == 0 {
+		return nil, fmt.Errorf("manifest list %s has no manifests", dig)
+	}
+	ii := imageInfo{Version: imageInfoVersion}
+	for _, m := range ml.Manifests {
+		child, err := r.getImageInfo(m.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query manifest %s of list %s: %s", m.Digest, dig, err)
+		}
+		if child.Created.After(ii.Created) {
+			ii.Created = child.Created
+		}
+		ii.Size += child.Size
+		ii.Children = append(ii.Children, m.Digest)
+		ii.Blobs = append(ii.Blobs, child.Blobs...)
+	}
+	return &ii, nil
+}
+
+// imageConfig is the part of an image configuration (or of a schema1
+// v1Compatibility entry) we are interested in.
+type imageConfig struct {
+	Created *time.Time `json:"created"`
+}
 
+func (r *repository) getManifestInfo(dig digest.Digest, mf distribution.Manifest) (*imageInfo, error) {
+	switch m := mf.(type) {
+	case *schema2.DeserializedManifest:
+		if m.Config.Digest == "" {
+			return nil, fmt.Errorf("manifest %s has no config", dig)
+		}
+		pl, err := r.blobs.Get(r.ctx, m.Config.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query config %s of manifest %s: %s", m.Config.Digest, dig, err)
+		}
+		tm, err := configCreated(m.Config.Digest, pl)
+		if err != nil {
+			return nil, err
+		}
+		ii := &imageInfo{Version: imageInfoVersion, Created: *tm, Size: m.Config.Size}
+		ii.Blobs = append(ii.Blobs, blobRef{Digest: m.Config.Digest, Size: m.Config.Size})
+		for _, l := range m.Layers {
+			ii.Size += l.Size
+			ii.Blobs = append(ii.Blobs, blobRef{Digest: l.Digest, Size: l.Size})
+		}
+		return ii, nil
+	case *schema1.SignedManifest:
+		// schema1 manifests do not contain the sizes of the layers
+		tm, err := schema1Created(dig, m)
+		if err != nil {
+			return nil, err
+		}
+		ii := &imageInfo{Version: imageInfoVersion, Created: *tm}
+		for _, l := range m.FSLayers {
+			ii.Blobs = append(ii.Blobs, blobRef{Digest: l.BlobSum})
+		}
+		return ii, nil
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %T for digest %s", mf, dig)
+	}
+}
+
+func configCreated(dig digest.Digest, pl []byte) (*time.Time, error) {
+	var cfg imageConfig
+	if err := json.Unmarshal(pl, &cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse config %s: %s", dig, err)
+	}
+	if cfg.Created == nil {
+		return nil, fmt.Errorf("config %s has no created time", dig)
+	}
+	return cfg.Created, nil
+}
+
+// schema1Created uses the first history entry, it describes the topmost layer
+// of the image.
+func schema1Created(dig digest.Digest, m *schema1.SignedManifest) (*time.Time, error) {
+	if len(m.History) == 0 {
+		return nil, fmt.Errorf("manifest %s has no history", dig)
+	}
+	v1 := m.History[0].V1Compatibility
+	if v1 == "" {
+		return nil, fmt.Errorf("no v1Compatibility node in history object of manifest %s", dig)
+	}
+	var cfg imageConfig
+	if err := json.Unmarshal([]byte(v1), &cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse v1Compatibility of manifest %s: %s", dig, err)
+	}
+	if cfg.Created == nil {
+		return nil, fmt.Errorf("v1Compatibility of manifest %s has no created time", dig)
+	}
+	return cfg.Created, nil
+}
+
+// getBlobInfos looks up all tags of the repository, at most -concurrency
+// lookups run at the same time. The result keeps the order of the tags.
+func (r *repository) getBlobInfos() ([]blobinfo, error) {
 	all, err := r.tags.All(r.ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, t := range all {
-		log.WithFields(log.Fields{
-			"repository": r.reponame,
-			"tag":        t,
-		}).Info("processing tagged repository")
+	infos := make([]*blobinfo, len(all))
+	var wg sync.WaitGroup
+	for i, t := range all {
+		wg.Add(1)
+		lookups <- struct{}{}
+		go func(i int, t string) {
+			defer func() {
+				<-lookups
+				wg.Done()
+			}()
+			infos[i] = r.getBlobInfo(t)
+		}(i, t)
+	}
+	wg.Wait()
 
-		tg, e := r.tags.Get(r.ctx, t)
-		if e != nil {
-			log.WithFields(log.Fields{
-				"tag":   t,
-				"error": e,
-			}).Error("cannot query tag descriptor")
-			continue
+	var result []blobinfo
+	for _, bi := range infos {
+		if bi != nil {
+			result = append(result, *bi)
 		}
+	}
+	return result, nil
+}
+
+func (r *repository) getBlobInfo(t string) *blobinfo {
+	log.WithFields(log.Fields{
+		"repository": r.reponame,
+		"tag":        t,
+	}).Info("processing tagged repository")
+
+	tg, e := r.tags.Get(r.ctx, t)
+	if e != nil {
+		log.WithFields(log.Fields{
+			"repname": r.reponame,
+			"tag":     t,
+			"error":   e,
+		}).Error("cannot query tag descriptor")
+		return &blobinfo{tag: t, repo: r.reponame, err: e}
+	}
 
-		repname := fmt.Sprintf("%s:%s", r.reponame, t)
-		if keepRepo != nil && keepRepo.FindString(repname) != "" {
+	repname := fmt.Sprintf("%s:%s", r.reponame, t)
+	keep := keepRepo != nil && keepRepo.FindString(repname) != ""
+	if keep {
+		log.WithFields(log.Fields{
+			"repname": r.reponame,
+			"tag":     t,
+			"type":    tg.MediaType,
+		}).Info("keep repo which is matched by keep-regexp")
+	}
+	if keep && !fullLookup {
+		children, e := r.listChildren(tg)
+		if e != nil {
 			log.WithFields(log.Fields{
 				"repname": r.reponame,
 				"tag":     t,
-				"type":    tg.MediaType,
-			}).Info("keep repo which is matched by keep-regexp")
-			continue
+				"error":   e,
+			}).Error("cannot query manifest list")
 		}
-		tm, e := r.getCreated(tg.Digest)
-		if e != nil {
-			log.WithFields(log.Fields{
-				"repname":    r.reponame,
-				"tag":        t,
-				"descriptor": tg,
-				"error":      e,
-			}).Error("cannot get creation time")
-			continue
+		return &blobinfo{
+			tag:         t,
+			repo:        r.reponame,
+			digest:      tg.Digest,
+			mediaType:   tg.MediaType,
+			keep:        true,
+			children:    children,
+			childrenErr: e,
 		}
+	}
+	ii, e := r.getImageInfo(tg.Digest)
+	if e != nil {
 		log.WithFields(log.Fields{
 			"repname":    r.reponame,
 			"tag":        t,
 			"descriptor": tg,
-		}).Info("add tag info for inspection")
-
-		bi := blobinfo{
-			tag:     t,
-			repo:    r.reponame,
-			digest:  tg.Digest,
-			created: *tm,
-		}
-		result = append(result, bi)
+			"error":      e,
+		}).Error("cannot get creation time")
+		// keep the digest and its children, so they are protected from the
+		// deletion of other tags
+		children, ce := r.listChildren(tg)
+		return &blobinfo{tag: t, repo: r.reponame, digest: tg.Digest, mediaType: tg.MediaType, keep: keep, err: e, children: children, childrenErr: ce}
 	}
+	log.WithFields(log.Fields{
+		"repname":    r.reponame,
+		"tag":        t,
+		"descriptor": tg,
+	}).Info("add tag info for inspection")
 
-	return result, nil
+	return &blobinfo{
+		tag:       t,
+		repo:      r.reponame,
+		digest:    tg.Digest,
+		mediaType: ii.MediaType,
+		keep:      keep,
+		created:   ii.Created,
+		size:      ii.Size,
+		children:  ii.Children,
+		blobs:     ii.Blobs,
+	}
 }
 
 var (
-	user      = flag.String("user", "", "the user to login for your registry")
-	password  = flag.String("password", "", "the password to login for your registry")
-	numDays   = flag.Int("num", -1, "number of days to keep; keep negative when you want to dump the digest's")
-	dry       = flag.Bool("dry", false, "do not really delete")
-	keep      = flag.String("keep", "", "regexp for repositories which should not be deleted, will be matched against repname:tag")
-	remove    = flag.String("remove", ".*", "regexp for repositories which should be deleted, will be matched against repname:tag")
-	transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-	}
-	keepRepo   *regexp.Regexp
-	removeRepo *regexp.Regexp
+	user             = flag.String("user", "", "the user to login for your registry")
+	password         = flag.String("password", "", "the password to login for your registry; prefer -password-stdin or $"+passwordEnv)
+	passwordStdin    = flag.Bool("password-stdin", false, "read the password from stdin")
+	dockerConfigFile = flag.String("docker-config", "", "docker config.json to read credentials from when no -user is given (default ~/.docker/config.json)")
+	numDays          = flag.Int("num", -1, "number of days to keep; keep negative when you want to dump the digest's")
+	notPulled        = flag.Int("not-pulled", -1, "delete tags which were not pulled for this number of days according to the imported access logs; negative disables")
+	accessLog        = flag.String("access-log", "", "access log of the registry (logrus text or JSON) to import the manifest pulls from")
+	pullsFile        = flag.String("pulls-file", "pulls.json", "file where the last pulls imported from access logs are kept between runs")
+	dumpFormat       = flag.String("dump-format", "table", "format of the digest dump: table, json or csv")
+	dumpSort         = flag.String("dump-sort", "repository", "sort the digest dump by repository, created or size")
+	dumpFile         = flag.String("dump-file", "-", "file for the digest dump, - is stdout")
+	keepLast         = flag.Int("keep-last", 0, "number of newest digests per repository which are never deleted, regardless of their age")
+	dry              = flag.Bool("dry", false, "do not really delete")
+	keep             = flag.String("keep", "", "regexp for repositories which should not be deleted, will be matched against repname:tag")
+	remove           = flag.String("remove", ".*", "regexp for repositories which should be deleted, will be matched against repname:tag")
+	policyFile       = flag.String("policy", "", "YAML or JSON file with per-repository retention rules; replaces -num and -keep-last")
+	strategy         = flag.String("strategy", strategyDigest, "how to remove tags sharing a digest with kept tags: 'digest' leaves them alone, 'untag' replaces them with a placeholder which is deleted")
+	caFile           = flag.String("ca-file", "", "PEM file with additional CA certificates to trust")
+	certFile         = flag.String("cert", "", "client certificate for mutual TLS")
+	keyFile          = flag.String("key", "", "key of the client certificate")
+	certsDir         = flag.String("certs-dir", "/etc/docker/certs.d", "docker style certs.d directory, <dir>/<host>/ is searched for *.crt, *.cert and *.key files")
+	insecure         = flag.Bool("insecure", false, "do not verify the certificate of the registry")
+	cacheDir         = flag.String("cache-dir", "", "directory to cache the creation time and size of digests between runs")
+	retries          = flag.Int("retries", 5, "number of retries for GET, HEAD and DELETE requests failing with network errors, 429 or 5xx; 0 disables retries")
+	maxRPS           = flag.Float64("max-rps", 0, "maximum number of read requests per second; 0 is unlimited")
+	maxDeleteRPS     = flag.Float64("max-delete-rps", 0, "maximum number of delete requests per second; 0 is unlimited")
+	reportFile       = flag.String("report", "", "write a report of all examined tags and the decisions to this file")
+	reportFormat     = flag.String("report-format", "json", "format of the report: json or csv")
+	planFileName     = flag.String("plan-file", "plan.json", "plan file written by the plan command and read by the apply command")
+	planMaxAge       = flag.Duration("plan-max-age", 24*time.Hour, "apply refuses plans which are older; 0 accepts every plan")
+	concurrency      = flag.Int("concurrency", 1, "number of repositories and tags which are scanned in parallel")
+	storageDir       = flag.String("storage", "", "root directory of the filesystem storage of a stopped or read-only registry; it is cleaned up directly and no registry URL is given")
+	gc               = flag.Bool("gc", false, "run the garbage collection of the registry after the deletions, only with -storage")
+	gcDry            = flag.Bool("gc-dry", false, "only list the blobs the garbage collection would delete; implied by -dry")
+	deleteBroken     = flag.Bool("delete-broken", false, "verify command: delete the manifests of images whose blobs are missing")
+	danglingAge      = flag.Duration("dangling", 0, "delete untagged manifests which were pushed longer ago, only with -storage; 0 keeps them")
+	purgeUploads     = flag.Duration("purge-uploads", 0, "remove upload sessions of interrupted pushes which were started longer ago, only with -storage; 0 keeps them")
+	transport        http.RoundTripper
+	lookups          chan struct{}
+	digestCache      *cache
+	cleanupReport    *report
+	keepRepo         *regexp.Regexp
+	removeRepo       *regexp.Regexp
+	// fullLookup also queries the kept tags, the inventory and the space
+	// estimation need to know about them
+	fullLookup bool
+)
+
+const (
+	commandRun    = "run"
+	commandPlan   = "plan"
+	commandApply  = "apply"
+	commandVerify = "verify"
 )
 
 func main() {
 	flag.Parse()
-	registryURL := flag.Arg(0)
+	command, registryURL := commandRun, flag.Arg(0)
+	if flag.NArg() > 1 {
+		command, registryURL = flag.Arg(0), flag.Arg(1)
+	}
+	if *storageDir != "" {
+		command, registryURL = commandRun, storageURL(*storageDir)
+		if flag.NArg() > 0 {
+			command = flag.Arg(0)
+		}
+	}
 	if registryURL == "" {
 		fmt.Printf("Specify a registry URL\n")
 		os.Exit(0)
 	}
 	log.SetOutput(os.Stdout)
+	if inventoryMode() && command == commandRun && *dumpFile == "-" {
+		// keep the dump on stdout readable
+		log.SetOutput(os.Stderr)
+	}
 	formatter := &log.TextFormatter{
 		FullTimestamp: true,
 	}
 	log.SetFormatter(formatter)
+	var err error
 	if *keep != "" {
-		keepRepo = regexp.MustCompile(*keep)
+		keepRepo, err = regexp.Compile(*keep)
+		checkErr(err)
 	}
 	if *remove != "" {
-		removeRepo = regexp.MustCompile(*remove)
+		removeRepo, err = regexp.Compile(*remove)
+		checkErr(err)
+	}
+	if *concurrency < 1 {
+		checkErr(fmt.Errorf("concurrency must be at least 1"))
+	}
+	lookups = make(chan struct{}, *concurrency)
+	if *reportFile != "" {
+		if *reportFormat != "json" && *reportFormat != "csv" {
+			checkErr(fmt.Errorf("unknown report format: %s", *reportFormat))
+		}
+		cleanupReport = &report{}
+	}
+	if *cacheDir != "" {
+		digestCache, err = newCache(*cacheDir)
+		checkErr(err)
+	}
+	if *dumpFormat != "table" && *dumpFormat != "json" && *dumpFormat != "csv" {
+		checkErr(fmt.Errorf("unknown dump format: %s", *dumpFormat))
+	}
+	if *dumpSort != "repository" && *dumpSort != "created" && *dumpSort != "size" {
+		checkErr(fmt.Errorf("unknown dump sort order: %s", *dumpSort))
+	}
+	if command != commandRun && command != commandPlan && command != commandApply && command != commandVerify {
+		checkErr(fmt.Errorf("unknown command: %s", command))
+	}
+	fullLookup = inventoryMode() || *dry || command == commandPlan
+	if *gc && *storageDir == "" {
+		checkErr(fmt.Errorf("-gc needs -storage"))
+	}
+	if *danglingAge < 0 {
+		checkErr(fmt.Errorf("-dangling must not be negative"))
+	}
+	if *danglingAge > 0 && *storageDir == "" {
+		checkErr(fmt.Errorf("-dangling needs -storage"))
+	}
+	if *purgeUploads < 0 {
+		checkErr(fmt.Errorf("-purge-uploads must not be negative"))
+	}
+	if *purgeUploads > 0 && *storageDir == "" {
+		checkErr(fmt.Errorf("-purge-uploads needs -storage"))
+	}
+	if command == commandPlan && (*danglingAge > 0 || *purgeUploads > 0 || *gc) {
+		checkErr(fmt.Errorf("plan does not change the storage, -dangling, -purge-uploads and -gc cannot be used with it"))
+	}
+	if command == commandApply && *danglingAge > 0 {
+		checkErr(fmt.Errorf("-dangling deletes manifests which are not in the plan, it cannot be used with apply"))
+	}
+	if *strategy != strategyDigest && *strategy != strategyUntag {
+		checkErr(fmt.Errorf("unknown strategy: %s", *strategy))
+	}
+	pol := flagPolicy()
+	if *policyFile != "" {
+		pol, err = loadPolicy(*policyFile)
+		checkErr(err)
 	}
 	ctx := dockercontext.Background()
-	if *user != "" {
-		u, e := url.Parse(registryURL)
-		checkErr(e)
-		u.User = url.UserPassword(*user, *password)
-		registryURL = u.String()
+	sum := &summary{cache: digestCache, reclaimable: -1, sweptBlobs: -1, purgedUploads: -1, dangling: -1}
+	var pf *planFile
+	if command == commandApply {
+		pf, err = readPlan(*planFileName, registryURL, *planMaxAge)
+		checkErr(err)
+	}
+	var st *offlineStorage
+	var open openFunc
+	var cat func() (catalog, error)
+	if *storageDir != "" {
+		st, err = openStorage(ctx, *storageDir)
+		checkErr(err)
+		open = st.repository
+		cat = func() (catalog, error) { return st.ns, nil }
+	} else {
+		tr, err := newTransport(registryURL)
+		checkErr(err)
+		limiter := newRateLimitTransport(tr, *maxRPS, *maxDeleteRPS)
+		transport = newRetryTransport(limiter, *retries)
+		username, pw, token, err := resolveCredentials(registryURL)
+		checkErr(err)
+		ra, err := newRegistryAuth(registryURL, transport, username, pw, token)
+		checkErr(err)
+		// a plan needs the push permission when it untags, regardless of
+		// -strategy
+		ra.push = *strategy == strategyUntag || pf != nil && pf.untags()
+		sum.limiter = limiter
+		open = func(ctx context.Context, name string) (*repository, error) {
+			return getRepository(ctx, registryURL, name, ra.repositoryTransport(name))
+		}
+		cat = func() (catalog, error) {
+			return client.NewRegistry(ctx, registryURL, ra.catalogTransport())
+		}
 	}
 
-	oldest := time.Now().Add(time.Duration(*numDays) * -24 * time.Hour)
+	allRepos := func() []string {
+		reg, err := cat()
+		checkErr(err)
+		log.Info("query all repos ...")
+		repos, err := getAllRepos(ctx, reg)
+		checkErr(err)
+		sum.repos = len(repos)
+		return repos
+	}
+	switch command {
+	case commandApply:
+		applyPlan(ctx, pf, open, sum)
+	case commandVerify:
+		verifyRepositories(ctx, allRepos(), open, sum)
+	default:
+		results := scanRepositories(ctx, allRepos(), open)
+		if *accessLog != "" || pol.usesPulls() {
+			checkErr(usePulls(results))
+		}
+		if command == commandPlan {
+			checkErr(writePlan(*planFileName, registryURL, results, pol, sum))
+		} else if inventoryMode() {
+			checkErr(dumpInventory(*dumpFile, results, sum))
+		} else {
+			cleanRepositories(results, pol, sum)
+		}
+		if *policyFile != "" {
+			pol.reportUnmatched()
+		}
+	}
+	// the storage is cleaned up whenever it is asked for, also without a
+	// retention
+	if *danglingAge > 0 {
+		st.deleteDangling(ctx, *danglingAge, sum)
+	}
+	if *purgeUploads > 0 {
+		if e := st.purgeUploads(ctx, time.Now().Add(-*purgeUploads), *dry, sum); e != nil {
+			sum.fail("(uploads)", e)
+		}
+	}
+	if *gc {
+		if e := st.collectGarbage(ctx, *dry || *gcDry, sum); e != nil {
+			sum.fail("(garbage collection)", e)
+		}
+	}
+	if cleanupReport != nil {
+		checkErr(cleanupReport.write(*reportFile, *reportFormat))
+	}
+	os.Exit(sum.print())
+}
 
-	reg, err := client.NewRegistry(ctx, registryURL, transport)
-	checkErr(err)
-	log.Info("query all repos ...")
-	repos := getAllRepos(ctx, reg)
+// inventoryMode is active when no retention is configured at all, the
+// digests are only dumped then.
+func inventoryMode() bool {
+	return *numDays < 0 && *notPulled < 0 && *policyFile == ""
+}
 
-	for _, r := range repos {
-		log.WithFields(log.Fields{
-			"repository": r,
-		}).Info("Processing")
-		rep, e := getRepository(ctx, registryURL, r)
-		checkErr(e)
-		blobs, e := rep.getBlobInfos()
-		checkErr(e)
-		for _, b := range blobs {
-			if *numDays >= 0 {
-				if b.created.Before(oldest) {
-					repname := fmt.Sprintf("%s:%s", b.repo, b.tag)
-					if removeRepo != nil && removeRepo.FindString(repname) == "" {
-						log.WithFields(log.Fields{
-							"reponame": repname,
-							"created":  b.created.Format(time.RFC3339),
-						}).Info("repo is too old but not matche by remove-regexp, ignoring")
-						continue
-					}
-					log.WithFields(log.Fields{
-						"reponame": repname,
-						"created":  b.created.Format(time.RFC3339),
-					}).Info("repo matched for deletion")
-					if *dry {
-						log.WithFields(log.Fields{
-							"repo":   rep.reponame,
-							"digest": b.digest,
-						}).Info("DRY DELETE")
-					} else {
-						e = rep.manifests.Delete(rep.ctx, b.digest)
-						if e != nil {
-							log.WithFields(log.Fields{
-								"digest": b.digest,
-								"error":  e,
-							}).Error("error deleting digest")
-						}
-					}
-				}
-			}
+func cleanRepositories(results []scanResult, pol *policy, sum *summary) {
+	var plans []repositoryPlan
+	for _, sr := range results {
+		if sr.err != nil {
+			sum.fail(sr.name, sr.err)
+			continue
+		}
+		plans = append(plans, repositoryPlan{scan: sr, dels: planDeletions(sr.blobs, pol, time.Now())})
+	}
+	if *dry {
+		sum.reclaimable = estimateReclaimable(plans)
+	}
+	for _, p := range plans {
+		e := p.scan.rep.deleteAll(p.scan.blobs, p.dels)
+		if e == nil {
+			e = lookupFailures(p.scan.blobs)
+		}
+		if e != nil {
+			sum.fail(p.scan.name, e)
 		}
 	}
-
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// unknownManifest is a manifest type the cleaner does not support.
+type unknownManifest struct{}
+
+func (unknownManifest) References() []distribution.Descriptor { return nil }
+
+func (unknownManifest) Payload() (string, []byte, error) {
+	return "application/x-unknown", nil, nil
+}
+
+func schema1Manifest(history ...string) *schema1.SignedManifest {
+	m := &schema1.SignedManifest{}
+	for _, h := range history {
+		m.History = append(m.History, schema1.History{V1Compatibility: h})
+	}
+	return m
+}
+
+func TestMalformedManifests(t *testing.T) {
+	dig := digest.FromBytes([]byte("manifest"))
+	r := &repository{}
+	tests := []struct {
+		name string
+		fn   func() error
+		err  string
+	}{
+		{"config without created", func() error {
+			_, err := configCreated(dig, []byte(`{"architecture":"amd64"}`))
+			return err
+		}, "has no created time"},
+		{"unparsable created", func() error {
+			_, err := configCreated(dig, []byte(`{"created":"yesterday"}`))
+			return err
+		}, "cannot parse config"},
+		{"config is no JSON", func() error {
+			_, err := configCreated(dig, []byte(`not json`))
+			return err
+		}, "cannot parse config"},
+		{"schema1 with empty history", func() error {
+			_, err := schema1Created(dig, schema1Manifest())
+			return err
+		}, "has no history"},
+		{"schema1 with empty v1Compatibility", func() error {
+			_, err := schema1Created(dig, schema1Manifest(""))
+			return err
+		}, "no v1Compatibility node"},
+		{"schema1 v1Compatibility without created", func() error {
+			_, err := schema1Created(dig, schema1Manifest(`{"id":"abc"}`))
+			return err
+		}, "has no created time"},
+		{"schema1 unparsable v1Compatibility", func() error {
+			_, err := schema1Created(dig, schema1Manifest(`{"created":42}`))
+			return err
+		}, "cannot parse v1Compatibility"},
+		{"schema2 without config digest", func() error {
+			_, err := r.getManifestInfo(dig, &schema2.DeserializedManifest{})
+			return err
+		}, "has no config"},
+		{"empty manifest list", func() error {
+			_, err := r.getListInfo(dig, &manifestlist.DeserializedManifestList{})
+			return err
+		}, "has no manifests"},
+		{"unsupported manifest type", func() error {
+			_, err := r.getManifestInfo(dig, unknownManifest{})
+			return err
+		}, "unsupported manifest type"},
+	}
+	for _, tc := range tests {
+		err := func() (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					t.Errorf("%s: panic: %v", tc.name, p)
+				}
+			}()
+			return tc.fn()
+		}()
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %q does not contain %q", tc.name, err, tc.err)
+		}
+		if !strings.Contains(err.Error(), dig.String()) {
+			t.Errorf("%s: error %q does not name the digest", tc.name, err)
+		}
+	}
+}
+
+func TestConfigCreated(t *testing.T) {
+	dig := digest.FromBytes([]byte("config"))
+	tm, err := configCreated(dig, []byte(`{"created":"2016-08-01T10:00:00Z"}`))
+	if err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+	if tm.Format(time.RFC3339) != "2016-08-01T10:00:00Z" {
+		t.Errorf("unexpected created time %s", tm)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+)
+
+const repositoriesRoot = "/docker/registry/v2/repositories/"
+
+// offlineStorage is the storage of a stopped or read-only registry which is
+// cleaned up directly instead of through the API.
+type offlineStorage struct {
+	dir    string
+	driver storagedriver.StorageDriver
+	ns     distribution.Namespace
+}
+
+func openStorage(ctx context.Context, dir string) (*offlineStorage, error) {
+	if _, err := os.Stat(filepath.Join(dir, "docker", "registry", "v2")); err != nil {
+		return nil, fmt.Errorf("no registry storage found in %s: %s", dir, err)
+	}
+	drv, err := filesystem.FromParameters(map[string]interface{}{"rootdirectory": dir})
+	if err != nil {
+		return nil, err
+	}
+	ns, err := storage.NewRegistry(ctx, drv, storage.EnableDelete)
+	if err != nil {
+		return nil, err
+	}
+	return &offlineStorage{dir: dir, driver: drv, ns: ns}, nil
+}
+
+// storageURL identifies the storage in plan files like the URL of a registry.
+func storageURL(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return "file://" + dir
+}
+
+func (s *offlineStorage) repository(ctx context.Context, repname string) (*repository, error) {
+	name, err := reference.ParseNamed(repname)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := s.ns.Repository(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRepository(ctx, storageURL(s.dir), repname, rep)
+	if err != nil {
+		return nil, err
+	}
+	r.offline = true
+	return r, nil
+}
+
+// collectGarbage runs the mark and sweep of the registry and reports the
+// blobs it removed. MarkAndSweep itself only prints what it marks in dry-run
+// mode, so the blobs are compared before and after. A dry run sweeps nothing
+// and leaves the numbers out of the summary.
+func (s *offlineStorage) collectGarbage(ctx context.Context, dryRun bool, sum *summary) error {
+	log.WithFields(log.Fields{
+		"dry": dryRun,
+	}).Info("running garbage collection")
+	if dryRun {
+		if err := storage.MarkAndSweep(ctx, s.driver, s.ns, true); err != nil {
+			return err
+		}
+		log.Info("dry run of garbage collection finished, nothing was swept")
+		return nil
+	}
+	before, err := s.blobSizes(ctx)
+	if err != nil {
+		return err
+	}
+	if err := storage.MarkAndSweep(ctx, s.driver, s.ns, false); err != nil {
+		return err
+	}
+	after, err := s.blobSizes(ctx)
+	if err != nil {
+		return err
+	}
+	sum.sweptBlobs, sum.sweptBytes = 0, 0
+	for d, size := range before {
+		if _, ok := after[d]; !ok {
+			sum.sweptBlobs++
+			sum.sweptBytes += size
+		}
+	}
+	log.WithFields(log.Fields{
+		"blobs": sum.sweptBlobs,
+		"bytes": sum.sweptBytes,
+		"swept": humanSize(sum.sweptBytes),
+	}).Info("garbage collection finished")
+	return nil
+}
+
+// blobSizes returns the size of every blob in the storage. Blobs which cannot
+// be read are logged and left out, they do not stop the garbage collection.
+func (s *offlineStorage) blobSizes(ctx context.Context) (map[digest.Digest]int64, error) {
+	sizes := make(map[digest.Digest]int64)
+	statter := s.ns.BlobStatter()
+	err := s.ns.Blobs().Enumerate(ctx, func(d digest.Digest) error {
+		desc, err := statter.Stat(ctx, d)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"digest": d,
+				"error":  err,
+			}).Warn("cannot stat blob, not counting it")
+			return nil
+		}
+		sizes[d] = desc.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/digest"
+)
+
+type deletion struct {
+	digest digest.Digest
+	tags   []string
+	// untag is set when only the tags should be removed because the digest
+	// is still referenced by other tags.
+	untag bool
+	// child is set for an untagged child of deleted manifest lists which is
+	// referenced by nothing else.
+	child bool
+	// reason explains the deletion to the reviewers of a plan
+	reason string
+}
+
+// eligible returns why the given tag may not be deleted on its own, or an
+// empty string when it may. Tags which could not be looked up, are kept,
+// protected by their rule, too young, pulled recently, among the newest of
+// their rule or not matched by the remove-regexp are not eligible.
+func eligible(b blobinfo, r *rule, recent map[digest.Digest]bool, now time.Time) string {
+	if b.err != nil {
+		return "lookup failed"
+	}
+	if b.keep {
+		return "matched by keep-regexp"
+	}
+	repname := fmt.Sprintf("%s:%s", b.repo, b.tag)
+	if r == nil {
+		log.WithFields(log.Fields{
+			"reponame": repname,
+		}).Info("repo is not matched by any policy rule, ignoring")
+		return "not matched by any policy rule"
+	}
+	if r.MaxAge == nil && r.NotPulled == nil {
+		return "rule has no max-age"
+	}
+	if r.MaxAge != nil && !b.created.Before(r.oldest(now)) {
+		return "too young"
+	}
+	if r.NotPulled != nil && !r.idle(b, now) {
+		return "pulled recently"
+	}
+	if r.protects(b.tag) {
+		log.WithFields(log.Fields{
+			"reponame": repname,
+			"rule":     r.Name,
+		}).Info("repo is protected by policy rule")
+		return "protected by rule"
+	}
+	if recent[b.digest] {
+		log.WithFields(log.Fields{
+			"reponame": repname,
+			"rule":     r.Name,
+			"keeplast": r.KeepLast,
+		}).Info("repo is one of the newest in repository, keeping")
+		return fmt.Sprintf("one of the newest %d", r.KeepLast)
+	}
+	if removeRepo != nil && removeRepo.FindString(repname) == "" {
+		log.WithFields(log.Fields{
+			"reponame": repname,
+			"created":  b.created.Format(time.RFC3339),
+		}).Info("repo is too old but not matche by remove-regexp, ignoring")
+		return "not matched by remove-regexp"
+	}
+	return ""
+}
+
+// newestDigests returns the n most recent distinct digests of a repository.
+func newestDigests(blobs []blobinfo, n int) map[digest.Digest]bool {
+	sorted := make([]blobinfo, 0, len(blobs))
+	for _, b := range blobs {
+		if !b.keep && b.err == nil {
+			sorted = append(sorted, b)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].created.After(sorted[j].created)
+	})
+	result := make(map[digest.Digest]bool)
+	for _, b := range sorted {
+		if len(result) >= n {
+			break
+		}
+		result[b.digest] = true
+	}
+	return result
+}
+
+// planDeletions groups the tags of a repository by their digest. The registry
+// deletes manifests by digest, so a digest is only scheduled for deletion when
+// every tag referencing it is eligible. Nothing is scheduled when the digest
+// of a tag is unknown.
+func planDeletions(blobs []blobinfo, pol *policy, now time.Time) []deletion {
+	var order []digest.Digest
+	groups := make(map[digest.Digest][]blobinfo)
+	rules := make(map[string]*rule)
+	byRule := make(map[*rule][]blobinfo)
+	for i := range blobs {
+		r := pol.match(blobs[i].repo, blobs[i].tag)
+		if r != nil {
+			// remember the rule in the callers slice for the report
+			blobs[i].rule = r.Name
+		}
+		b := blobs[i]
+		if _, ok := groups[b.digest]; !ok {
+			order = append(order, b.digest)
+		}
+		groups[b.digest] = append(groups[b.digest], b)
+		rules[b.tag] = r
+		byRule[r] = append(byRule[r], b)
+	}
+
+	// a tag whose digest is unknown may point to any digest of the
+	// repository, deleting one of them could remove it as well
+	if t := unknownDigest(blobs); t != "" {
+		log.WithFields(log.Fields{
+			"repname": blobs[0].repo,
+			"tag":     t,
+		}).Warn("digest of tag is unknown, not deleting anything in repository")
+		for _, b := range blobs {
+			if b.err != nil {
+				cleanupReport.add(b, decisionError, "lookup failed", b.err)
+			} else {
+				cleanupReport.add(b, decisionKept, fmt.Sprintf("digest of tag %s is unknown", t), nil)
+			}
+		}
+		return nil
+	}
+
+	// keep-last is applied to the tags matched by the same rule
+	recent := make(map[*rule]map[digest.Digest]bool)
+	for r, bs := range byRule {
+		if r != nil {
+			recent[r] = newestDigests(bs, r.KeepLast)
+		}
+	}
+
+	var result []deletion
+	for _, dig := range order {
+		var tags, saved []string
+		for _, b := range groups[dig] {
+			r := rules[b.tag]
+			if reason := eligible(b, r, recent[r], now); reason != "" {
+				saved = append(saved, b.tag)
+				decision := decisionKept
+				if b.err != nil {
+					decision = decisionError
+				}
+				cleanupReport.add(b, decision, reason, b.err)
+			} else {
+				tags = append(tags, b.tag)
+			}
+		}
+		if len(tags) == 0 {
+			continue
+		}
+		if len(saved) > 0 && *strategy == strategyUntag {
+			log.WithFields(log.Fields{
+				"repname":  groups[dig][0].repo,
+				"digest":   dig,
+				"eligible": tags,
+				"keptby":   saved,
+			}).Info("digest is still referenced by kept tags, untagging")
+			reason := fmt.Sprintf("untag: digest still referenced by %v", saved)
+			result = append(result, deletion{digest: dig, tags: tags, untag: true, reason: reason})
+			continue
+		}
+		if len(saved) > 0 {
+			log.WithFields(log.Fields{
+				"repname":  groups[dig][0].repo,
+				"digest":   dig,
+				"eligible": tags,
+				"keptby":   saved,
+			}).Info("digest is still referenced by kept tags, not deleting")
+			for _, b := range groups[dig] {
+				if contains(tags, b.tag) {
+					cleanupReport.add(b, decisionKept, fmt.Sprintf("digest is still referenced by %v", saved), nil)
+				}
+			}
+			continue
+		}
+		for _, t := range tags {
+			log.WithFields(log.Fields{
+				"reponame": fmt.Sprintf("%s:%s", groups[dig][0].repo, t),
+				"created":  groups[dig][0].created.Format(time.RFC3339),
+			}).Info("repo matched for deletion")
+		}
+		var reasons []string
+		for _, t := range tags {
+			if r := rules[t].deleteReason(); !contains(reasons, r) {
+				reasons = append(reasons, r)
+			}
+		}
+		result = append(result, deletion{digest: dig, tags: tags, reason: strings.Join(reasons, "; ")})
+	}
+	return addCascade(blobs, keepListChildren(result, groups))
+}
+
+// addCascade appends the deletions of the children of deleted manifest lists
+// which are no longer referenced.
+func addCascade(blobs []blobinfo, dels []deletion) []deletion {
+	deleted := make(map[digest.Digest]bool)
+	for _, d := range dels {
+		if !d.untag {
+			deleted[d.digest] = true
+		}
+	}
+	for _, c := range planCascade(blobs, deleted) {
+		var list digest.Digest
+		for _, b := range blobs {
+			if deleted[b.digest] && containsDigest(b.children, c) {
+				list = b.digest
+				break
+			}
+		}
+		reason := fmt.Sprintf("unreferenced child of deleted list %s", list)
+		dels = append(dels, deletion{digest: c, child: true, reason: reason})
+	}
+	return dels
+}
+
+func containsDigest(l []digest.Digest, d digest.Digest) bool {
+	for _, e := range l {
+		if e == d {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownDigest returns the first tag whose descriptor could not be looked
+// up, or an empty string.
+func unknownDigest(blobs []blobinfo) string {
+	for _, b := range blobs {
+		if b.err != nil && b.digest == "" {
+			return b.tag
+		}
+	}
+	return ""
+}
+
+// keepListChildren drops the deletion of digests which are children of a
+// manifest list that stays in the repository, a list and its children are
+// one unit.
+func keepListChildren(dels []deletion, groups map[digest.Digest][]blobinfo) []deletion {
+	deleted := make(map[digest.Digest]bool)
+	for _, d := range dels {
+		if !d.untag {
+			deleted[d.digest] = true
+		}
+	}
+	usedBy := make(map[digest.Digest]digest.Digest)
+	for dig, bs := range groups {
+		if deleted[dig] {
+			continue
+		}
+		for _, c := range bs[0].children {
+			usedBy[c] = dig
+		}
+	}
+	var result []deletion
+	for _, d := range dels {
+		if list, ok := usedBy[d.digest]; ok && !d.untag {
+			log.WithFields(log.Fields{
+				"repname": groups[d.digest][0].repo,
+				"digest":  d.digest,
+				"tags":    d.tags,
+				"list":    list,
+			}).Info("digest is part of a kept manifest list, not deleting")
+			for _, b := range groups[d.digest] {
+				if contains(d.tags, b.tag) {
+					cleanupReport.add(b, decisionKept, fmt.Sprintf("part of kept manifest list %s", list), nil)
+				}
+			}
+			continue
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+// planCascade returns the children of the deleted manifest lists which are
+// not referenced by any remaining tag or manifest list of the repository.
+// Nothing is returned when the children of a remaining tag or even its digest
+// are unknown, they might be shared with a deleted list.
+func planCascade(blobs []blobinfo, deleted map[digest.Digest]bool) []digest.Digest {
+	referenced := make(map[digest.Digest]bool)
+	for _, b := range blobs {
+		if deleted[b.digest] {
+			continue
+		}
+		err := b.childrenErr
+		if b.err != nil && b.digest == "" {
+			err = b.err
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"repname": b.repo,
+				"tag":     b.tag,
+				"error":   err,
+			}).Warn("manifest list children of kept tag are unknown, not deleting children of deleted lists")
+			return nil
+		}
+		referenced[b.digest] = true
+		for _, c := range b.children {
+			referenced[c] = true
+		}
+	}
+	var result []digest.Digest
+	seen := make(map[digest.Digest]bool)
+	for _, b := range blobs {
+		if !deleted[b.digest] {
+			continue
+		}
+		for _, c := range b.children {
+			if referenced[c] || seen[c] || deleted[c] {
+				continue
+			}
+			seen[c] = true
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func testDigest(s string) digest.Digest {
+	return digest.FromBytes([]byte(s))
+}
+
+func describeDeletions(dels []deletion) []string {
+	var result []string
+	for _, d := range dels {
+		result = append(result, fmt.Sprintf("%s %v untag=%v child=%v reason=%q", d.digest, d.tags, d.untag, d.child, d.reason))
+	}
+	return result
+}
+
+func TestPlanDeletions(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-30 * 24 * time.Hour)
+	older := now.Add(-40 * 24 * time.Hour)
+	young := now.Add(-time.Hour)
+	d1, d2, d3 := testDigest("one"), testDigest("two"), testDigest("three")
+	list, c1, c2 := testDigest("list"), testDigest("child1"), testDigest("child2")
+	expired := "older than 7 days"
+
+	tests := []struct {
+		name     string
+		keepLast int
+		blobs    []blobinfo
+		want     []deletion
+	}{
+		{
+			name: "expired digest",
+			blobs: []blobinfo{
+				{tag: "old", digest: d1, created: old},
+				{tag: "new", digest: d2, created: young},
+			},
+			want: []deletion{{digest: d1, tags: []string{"old"}, reason: expired}},
+		},
+		{
+			name: "unknown digest blocks all deletions",
+			blobs: []blobinfo{
+				{tag: "old", digest: d1, created: old},
+				{tag: "stable", err: errors.New("cannot query tag")},
+			},
+		},
+		{
+			name: "failed lookup with known digest protects only it",
+			blobs: []blobinfo{
+				{tag: "old", digest: d1, created: old},
+				{tag: "stable", digest: d1, err: errors.New("cannot query config")},
+				{tag: "other", digest: d2, created: old},
+			},
+			want: []deletion{{digest: d2, tags: []string{"other"}, reason: expired}},
+		},
+		{
+			name: "shared digest with young tag",
+			blobs: []blobinfo{
+				{tag: "old", digest: d1, created: old},
+				{tag: "stable", digest: d1, created: old},
+				{tag: "latest", digest: d1, created: young},
+			},
+		},
+		{
+			name: "shared digest with all tags eligible",
+			blobs: []blobinfo{
+				{tag: "old", digest: d1, created: old},
+				{tag: "stable", digest: d1, created: old},
+			},
+			want: []deletion{{digest: d1, tags: []string{"old", "stable"}, reason: expired}},
+		},
+		{
+			name:     "keep-last",
+			keepLast: 1,
+			blobs: []blobinfo{
+				{tag: "a", digest: d1, created: older},
+				{tag: "b", digest: d2, created: old},
+				{tag: "c", digest: d3, created: older.Add(-time.Hour)},
+			},
+			want: []deletion{
+				{digest: d1, tags: []string{"a"}, reason: expired},
+				{digest: d3, tags: []string{"c"}, reason: expired},
+			},
+		},
+		{
+			name: "list with its children",
+			blobs: []blobinfo{
+				{tag: "multi", digest: list, created: old, children: []digest.Digest{c1, c2}},
+			},
+			want: []deletion{
+				{digest: list, tags: []string{"multi"}, reason: expired},
+				{digest: c1, child: true, reason: "unreferenced child of deleted list " + list.String()},
+				{digest: c2, child: true, reason: "unreferenced child of deleted list " + list.String()},
+			},
+		},
+		{
+			name: "list child which is tagged itself",
+			blobs: []blobinfo{
+				{tag: "multi", digest: list, created: old, children: []digest.Digest{c1, c2}},
+				{tag: "amd64", digest: c1, created: young},
+			},
+			want: []deletion{
+				{digest: list, tags: []string{"multi"}, reason: expired},
+				{digest: c2, child: true, reason: "unreferenced child of deleted list " + list.String()},
+			},
+		},
+		{
+			name: "child of kept list",
+			blobs: []blobinfo{
+				{tag: "multi", digest: list, created: young, children: []digest.Digest{c1, c2}},
+				{tag: "amd64", digest: c1, created: old},
+			},
+		},
+	}
+	for _, tc := range tests {
+		maxAge := 7
+		pol := &policy{Rules: []*rule{{Name: "test", MaxAge: &maxAge, KeepLast: tc.keepLast}}}
+		for i := range tc.blobs {
+			tc.blobs[i].repo = "app"
+		}
+		got := describeDeletions(planDeletions(tc.blobs, pol, now))
+		want := describeDeletions(tc.want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: planned %v, expected %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestPlanCascadeUnknownChildren(t *testing.T) {
+	list, child := testDigest("list"), testDigest("child")
+	deleted := map[digest.Digest]bool{list: true}
+	tests := []struct {
+		name string
+		kept blobinfo
+		want int
+	}{
+		{"known", blobinfo{tag: "other", digest: testDigest("other")}, 1},
+		{"children unknown", blobinfo{tag: "other", digest: testDigest("other"), err: errors.New("failed"), childrenErr: errors.New("failed")}, 0},
+		{"digest unknown", blobinfo{tag: "other", err: errors.New("failed")}, 0},
+	}
+	for _, tc := range tests {
+		blobs := []blobinfo{{tag: "multi", digest: list, children: []digest.Digest{child}}, tc.kept}
+		if got := planCascade(blobs, deleted); len(got) != tc.want {
+			t.Errorf("%s: cascade %v, expected %d children", tc.name, got, tc.want)
+		}
+	}
+}
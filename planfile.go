@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/digest"
+)
+
+// planFile is written by the plan command and executed by the apply command
+// after it has been reviewed.
+type planFile struct {
+	Registry string      `json:"registry"`
+	Created  time.Time   `json:"created"`
+	Entries  []planEntry `json:"entries"`
+}
+
+type planEntry struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Tags       []string      `json:"tags,omitempty"`
+	Created    time.Time     `json:"created"`
+	Untag      bool          `json:"untag,omitempty"`
+	// Child entries are untagged children of the deleted manifest lists
+	Child  bool     `json:"child,omitempty"`
+	Rules  []string `json:"rules,omitempty"`
+	Reason string   `json:"reason"`
+}
+
+// untags reports whether the plan removes single tags, which needs the push
+// permission on the repositories.
+func (pf *planFile) untags() bool {
+	for _, e := range pf.Entries {
+		if e.Untag {
+			return true
+		}
+	}
+	return false
+}
+
+func writePlan(fname, registryURL string, results []scanResult, pol *policy, sum *summary) error {
+	pf := planFile{Registry: registryURL, Created: time.Now().UTC(), Entries: []planEntry{}}
+	var plans []repositoryPlan
+	for _, sr := range results {
+		if sr.err != nil {
+			sum.fail(sr.name, sr.err)
+			continue
+		}
+		dels := planDeletions(sr.blobs, pol, time.Now())
+		if e := lookupFailures(sr.blobs); e != nil {
+			sum.fail(sr.name, e)
+		}
+		plans = append(plans, repositoryPlan{scan: sr, dels: dels})
+		byTag := make(map[string]blobinfo)
+		for _, b := range sr.blobs {
+			byTag[b.tag] = b
+		}
+		for _, d := range dels {
+			e := planEntry{
+				Repository: sr.name,
+				Digest:     d.digest,
+				Tags:       d.tags,
+				Untag:      d.untag,
+				Child:      d.child,
+				Reason:     d.reason,
+			}
+			if len(d.tags) > 0 {
+				e.Created = byTag[d.tags[0]].created
+			}
+			for _, t := range d.tags {
+				b := byTag[t]
+				cleanupReport.add(b, decisionSkipped, "planned", nil)
+				if b.rule != "" && !contains(e.Rules, b.rule) {
+					e.Rules = append(e.Rules, b.rule)
+				}
+			}
+			pf.Entries = append(pf.Entries, e)
+		}
+	}
+	sum.reclaimable = estimateReclaimable(plans)
+	data, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"file":    fname,
+		"entries": len(pf.Entries),
+	}).Info("writing plan")
+	return ioutil.WriteFile(fname, append(data, '\n'), 0644)
+}
+
+func readPlan(fname, registryURL string, maxAge time.Duration) (*planFile, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var pf planFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("cannot parse plan %s: %s", fname, err)
+	}
+	if pf.Registry != registryURL {
+		return nil, fmt.Errorf("plan %s was made for registry %s", fname, pf.Registry)
+	}
+	if maxAge > 0 && time.Since(pf.Created) > maxAge {
+		return nil, fmt.Errorf("plan %s was created %s and is older than %s", fname, pf.Created.Format(time.RFC3339), maxAge)
+	}
+	return &pf, nil
+}
+
+// applyPlan deletes the entries of the plan which are still valid: every tag
+// must still point to the planned digest and, unless only the tags are
+// removed, no other tag may have been added to the digest since planning.
+// Nothing but the entries of the plan is deleted.
+func applyPlan(ctx context.Context, pf *planFile, open openFunc, sum *summary) {
+	entries := make(map[string][]planEntry)
+	var repos []string
+	for _, e := range pf.Entries {
+		if _, ok := entries[e.Repository]; !ok {
+			repos = append(repos, e.Repository)
+		}
+		entries[e.Repository] = append(entries[e.Repository], e)
+	}
+	sort.Strings(repos)
+	sum.repos = len(repos)
+
+	for _, sr := range scanRepositories(ctx, repos, open) {
+		if sr.err != nil {
+			sum.fail(sr.name, sr.err)
+			continue
+		}
+		var dels []deletion
+		for _, e := range entries[sr.name] {
+			if reason := verifyPlanEntry(e, sr.blobs); reason != "" {
+				log.WithFields(log.Fields{
+					"repository": e.Repository,
+					"digest":     e.Digest,
+					"tags":       e.Tags,
+					"reason":     reason,
+				}).Warn("skipping stale plan entry")
+				for _, t := range e.Tags {
+					cleanupReport.add(blobinfo{repo: e.Repository, tag: t, digest: e.Digest, created: e.Created}, decisionSkipped, reason, nil)
+				}
+				continue
+			}
+			dels = append(dels, deletion{digest: e.Digest, tags: e.Tags, untag: e.Untag, child: e.Child})
+		}
+		e := sr.rep.deleteAll(sr.blobs, dels)
+		if e == nil {
+			e = lookupFailures(sr.blobs)
+		}
+		if e != nil {
+			sum.fail(sr.name, e)
+		}
+	}
+}
+
+func verifyPlanEntry(e planEntry, blobs []blobinfo) string {
+	if t := unknownDigest(blobs); t != "" {
+		return fmt.Sprintf("digest of tag %s is unknown", t)
+	}
+	byTag := make(map[string]blobinfo)
+	for _, b := range blobs {
+		byTag[b.tag] = b
+	}
+	for _, t := range e.Tags {
+		b, ok := byTag[t]
+		switch {
+		case !ok:
+			return fmt.Sprintf("tag %s no longer exists", t)
+		case b.err != nil:
+			return fmt.Sprintf("tag %s cannot be looked up: %s", t, b.err)
+		case b.digest != e.Digest:
+			return fmt.Sprintf("tag %s moved to %s", t, b.digest)
+		case !b.created.Equal(e.Created):
+			return fmt.Sprintf("tag %s has a different creation time", t)
+		}
+	}
+	if e.Untag {
+		return ""
+	}
+	for _, b := range blobs {
+		if b.digest == e.Digest && !contains(e.Tags, b.tag) {
+			return fmt.Sprintf("digest is also referenced by tag %s", b.tag)
+		}
+	}
+	return ""
+}
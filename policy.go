@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A policy is an ordered list of retention rules. The first rule which
+// matches a repname:tag decides what happens with it.
+type policy struct {
+	Rules []*rule `yaml:"rules"`
+}
+
+type rule struct {
+	Name string `yaml:"name"`
+	// Repository and Tag are globs, RepositoryRegexp and TagRegexp are
+	// regular expressions. Empty patterns match everything.
+	Repository       string `yaml:"repository"`
+	RepositoryRegexp string `yaml:"repository-regexp"`
+	Tag              string `yaml:"tag"`
+	TagRegexp        string `yaml:"tag-regexp"`
+	// MaxAge is the number of days to keep; when it is not set the rule
+	// never deletes anything.
+	MaxAge *int `yaml:"max-age"`
+	// NotPulled is the number of days without a pull after which a tag may
+	// be deleted; tags which were never pulled count from their creation.
+	NotPulled *int     `yaml:"not-pulled"`
+	KeepLast  int      `yaml:"keep-last"`
+	Protect   []string `yaml:"protect"`
+
+	repoRegexp *regexp.Regexp
+	tagRegexp  *regexp.Regexp
+	matched    bool
+}
+
+func loadPolicy(fname string) (*policy, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPolicyKeys(data); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %s", fname, err)
+	}
+	var p policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("cannot parse policy %s: %s", fname, err)
+	}
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("policy %s contains no rules", fname)
+	}
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", r.Name, err)
+		}
+	}
+	return &p, nil
+}
+
+// ruleKeys are the settings of a rule. yaml.v2 ignores unknown keys, a typo
+// like "protected" would silently drop the protection of a rule.
+var ruleKeys = map[string]bool{
+	"name":              true,
+	"repository":        true,
+	"repository-regexp": true,
+	"tag":               true,
+	"tag-regexp":        true,
+	"max-age":           true,
+	"not-pulled":        true,
+	"keep-last":         true,
+	"protect":           true,
+}
+
+func checkPolicyKeys(data []byte) error {
+	var top map[string]interface{}
+	if err := yaml.Unmarshal(data, &top); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(top) {
+		if k != "rules" {
+			return fmt.Errorf("unknown key %q", k)
+		}
+	}
+	var raw struct {
+		Rules []map[string]interface{} `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for i, r := range raw.Rules {
+		for _, k := range sortedKeys(r) {
+			if !ruleKeys[k] {
+				return fmt.Errorf("unknown key %q in rule %d", k, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flagPolicy builds a single rule policy from the -num, -not-pulled and
+// -keep-last flags.
+func flagPolicy() *policy {
+	r := &rule{Name: "flags", KeepLast: *keepLast}
+	if *numDays >= 0 {
+		r.MaxAge = numDays
+	}
+	if *notPulled >= 0 {
+		r.NotPulled = notPulled
+	}
+	return &policy{Rules: []*rule{r}}
+}
+
+func (r *rule) compile() error {
+	var err error
+	for _, g := range append([]string{r.Repository, r.Tag}, r.Protect...) {
+		if _, err = path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %s", g, err)
+		}
+	}
+	if r.RepositoryRegexp != "" {
+		if r.repoRegexp, err = regexp.Compile(r.RepositoryRegexp); err != nil {
+			return err
+		}
+	}
+	if r.TagRegexp != "" {
+		if r.tagRegexp, err = regexp.Compile(r.TagRegexp); err != nil {
+			return err
+		}
+	}
+	if r.MaxAge != nil && *r.MaxAge < 0 {
+		return fmt.Errorf("max-age must not be negative")
+	}
+	if r.NotPulled != nil && *r.NotPulled < 0 {
+		return fmt.Errorf("not-pulled must not be negative")
+	}
+	if r.KeepLast < 0 {
+		return fmt.Errorf("keep-last must not be negative")
+	}
+	return nil
+}
+
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+func (r *rule) matches(repo, tag string) bool {
+	if !globMatch(r.Repository, repo) || !globMatch(r.Tag, tag) {
+		return false
+	}
+	if r.repoRegexp != nil && r.repoRegexp.FindString(repo) == "" {
+		return false
+	}
+	if r.tagRegexp != nil && r.tagRegexp.FindString(tag) == "" {
+		return false
+	}
+	return true
+}
+
+func (r *rule) protects(tag string) bool {
+	for _, p := range r.Protect {
+		if globMatch(p, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteReason describes why the rule deletes a tag.
+func (r *rule) deleteReason() string {
+	var reasons []string
+	if r.MaxAge != nil {
+		reasons = append(reasons, fmt.Sprintf("older than %d days", *r.MaxAge))
+	}
+	if r.NotPulled != nil {
+		reasons = append(reasons, fmt.Sprintf("not pulled for %d days", *r.NotPulled))
+	}
+	return strings.Join(reasons, " and ")
+}
+
+func (r *rule) oldest(now time.Time) time.Time {
+	return now.Add(time.Duration(*r.MaxAge) * -24 * time.Hour)
+}
+
+// idle tells whether the tag was not pulled for NotPulled days.
+func (r *rule) idle(b blobinfo, now time.Time) bool {
+	last := b.created
+	if b.lastPull.After(last) {
+		last = b.lastPull
+	}
+	return last.Before(now.Add(time.Duration(*r.NotPulled) * -24 * time.Hour))
+}
+
+// usesPulls tells whether a rule needs to know when tags were pulled.
+func (p *policy) usesPulls() bool {
+	for _, r := range p.Rules {
+		if r.NotPulled != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *policy) match(repo, tag string) *rule {
+	for _, r := range p.Rules {
+		if r.matches(repo, tag) {
+			r.matched = true
+			return r
+		}
+	}
+	return nil
+}
+
+func (p *policy) reportUnmatched() {
+	for _, r := range p.Rules {
+		if !r.matched {
+			log.WithFields(log.Fields{
+				"rule": r.Name,
+			}).Warn("policy rule did not match any tag")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPolicyRejectsUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{"valid", "rules:\n- name: base\n  repository: base/*\n  max-age: 30\n  protect: [latest]\n", ""},
+		{"json", `{"rules": [{"name": "ci", "repository-regexp": "^ci/", "max-age": 3}]}`, ""},
+		{"typo in protect", "rules:\n- name: base\n  max-age: 30\n  protected: [latest]\n", `unknown key "protected" in rule 1`},
+		{"typo in max-age", "rules:\n- name: a\n  max-age: 1\n- name: b\n  max_age: 30\n", `unknown key "max_age" in rule 2`},
+		{"unknown top level key", "rule:\n- name: base\n", `unknown key "rule"`},
+	}
+	for _, tc := range tests {
+		fname := filepath.Join(dir, "policy.yaml")
+		if err := ioutil.WriteFile(fname, []byte(tc.policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadPolicy(fname)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		case tc.err != "" && err == nil:
+			t.Errorf("%s: expected an error", tc.name)
+		case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+			t.Errorf("%s: error %q does not contain %q", tc.name, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/digest"
+)
+
+// pullLog is the last pull of each manifest, keyed by repository and digest.
+// It is imported from the access logs of the registry and kept between runs,
+// so it covers more than the logs which are still around.
+type pullLog struct {
+	Version int                                    `json:"v"`
+	Pulls   map[string]map[digest.Digest]time.Time `json:"pulls"`
+}
+
+const pullLogVersion = 1
+
+func loadPulls(fname string) (*pullLog, error) {
+	p := &pullLog{Version: pullLogVersion, Pulls: make(map[string]map[digest.Digest]time.Time)}
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("cannot parse pulls %s: %s", fname, err)
+	}
+	if p.Version != pullLogVersion {
+		return nil, fmt.Errorf("pulls %s has unknown version %d", fname, p.Version)
+	}
+	if p.Pulls == nil {
+		p.Pulls = make(map[string]map[digest.Digest]time.Time)
+	}
+	return p, nil
+}
+
+// save writes the file atomically, an interrupted run must not lose the
+// pulls of earlier runs.
+func (p *pullLog) save(fname string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, data)
+}
+
+func (p *pullLog) record(repo string, dig digest.Digest, t time.Time) {
+	if p.Pulls[repo] == nil {
+		p.Pulls[repo] = make(map[digest.Digest]time.Time)
+	}
+	if t.After(p.Pulls[repo][dig]) {
+		p.Pulls[repo][dig] = t.UTC()
+	}
+}
+
+// importAccessLog records the successful manifest GETs of the access log.
+// Pulls by tag are attributed to the digest the tag points to now; pulls of
+// unknown tags are ignored.
+func (p *pullLog) importAccessLog(fname string, results []scanResult) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tags := make(map[string]map[string]digest.Digest)
+	for _, sr := range results {
+		tags[sr.name] = make(map[string]digest.Digest)
+		for _, b := range sr.blobs {
+			if b.digest != "" {
+				tags[sr.name][b.tag] = b.digest
+			}
+		}
+	}
+
+	imported, unresolved := 0, 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		repo, ref, t, ok := parsePull(sc.Text())
+		if !ok {
+			continue
+		}
+		dig, err := digest.ParseDigest(ref)
+		if err != nil {
+			if dig, ok = tags[repo][ref]; !ok {
+				unresolved++
+				continue
+			}
+		}
+		p.record(repo, dig, t)
+		imported++
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("cannot read access log %s: %s", fname, err)
+	}
+	log.WithFields(log.Fields{
+		"file":       fname,
+		"pulls":      imported,
+		"unresolved": unresolved,
+	}).Info("imported access log")
+	return nil
+}
+
+// parsePull returns repository, reference and time of a successful manifest
+// GET in a logrus text or JSON line written by the registry.
+func parsePull(line string) (string, string, time.Time, bool) {
+	var f map[string]string
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		var j map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &j); err != nil {
+			return "", "", time.Time{}, false
+		}
+		f = make(map[string]string)
+		for k, v := range j {
+			f[k] = fmt.Sprint(v)
+		}
+	} else {
+		f = parseLogfmt(line)
+	}
+	if f["http.request.method"] != "GET" || !strings.HasPrefix(f["http.response.status"], "2") {
+		return "", "", time.Time{}, false
+	}
+	repo, ref := manifestRequest(f["http.request.uri"])
+	if repo == "" || ref == "" {
+		return "", "", time.Time{}, false
+	}
+	// the route variables are only logged with some requests
+	if f["vars.name"] != "" && f["vars.reference"] != "" {
+		repo, ref = f["vars.name"], f["vars.reference"]
+	}
+	t, err := time.Parse(time.RFC3339Nano, f["time"])
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	return repo, ref, t, true
+}
+
+// manifestRequest returns repository and reference of a
+// /v2/<name>/manifests/<reference> request URI.
+func manifestRequest(uri string) (string, string) {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.HasPrefix(u.Path, "/v2/") {
+		return "", ""
+	}
+	p := strings.TrimPrefix(u.Path, "/v2/")
+	i := strings.LastIndex(p, "/manifests/")
+	if i <= 0 {
+		return "", ""
+	}
+	return p[:i], p[i+len("/manifests/"):]
+}
+
+// parseLogfmt splits a logrus text line into its key=value pairs, values may
+// be quoted.
+func parseLogfmt(line string) map[string]string {
+	f := make(map[string]string)
+	for {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return f
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+		if strings.HasPrefix(line, `"`) {
+			end := 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return f
+			}
+			v, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return f
+			}
+			f[key] = v
+			line = line[end+1:]
+			continue
+		}
+		sp := strings.IndexByte(line, ' ')
+		if sp < 0 {
+			sp = len(line)
+		}
+		f[key] = line[:sp]
+		line = line[sp:]
+	}
+}
+
+// usePulls loads the pulls, imports the access log and sets the last pull of
+// the scanned tags.
+func usePulls(results []scanResult) error {
+	pulls, err := loadPulls(*pullsFile)
+	if err != nil {
+		return err
+	}
+	if *accessLog != "" {
+		if err := pulls.importAccessLog(*accessLog, results); err != nil {
+			return err
+		}
+		if err := pulls.save(*pullsFile); err != nil {
+			return err
+		}
+	}
+	for _, sr := range results {
+		for i, b := range sr.blobs {
+			sr.blobs[i].lastPull = pulls.Pulls[b.repo][b.digest]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket allows rate requests per second on average with bursts of up
+// to one second worth of requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller has to wait until
+// the token is available.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitTransport limits read and delete requests separately and counts
+// the requests, so the effective rates can be reported.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	read    *tokenBucket
+	delete  *tokenBucket
+	start   time.Time
+	reads   int64
+	deletes int64
+}
+
+func newRateLimitTransport(base http.RoundTripper, readRPS, deleteRPS float64) *rateLimitTransport {
+	return &rateLimitTransport{
+		base:   base,
+		read:   newTokenBucket(readRPS),
+		delete: newTokenBucket(deleteRPS),
+		start:  time.Now(),
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket := t.read
+	if req.Method == "DELETE" {
+		bucket = t.delete
+		atomic.AddInt64(&t.deletes, 1)
+	} else {
+		atomic.AddInt64(&t.reads, 1)
+	}
+	if bucket != nil {
+		if wait := bucket.reserve(); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// rates returns the effective read and delete requests per second since the
+// transport was created.
+func (t *rateLimitTransport) rates() (float64, float64) {
+	secs := time.Since(t.start).Seconds()
+	if secs <= 0 {
+		return 0, 0
+	}
+	return float64(atomic.LoadInt64(&t.reads)) / secs, float64(atomic.LoadInt64(&t.deletes)) / secs
+}
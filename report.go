@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	decisionKept    = "kept"
+	decisionDeleted = "deleted"
+	decisionSkipped = "skipped"
+	decisionError   = "error"
+)
+
+type reportEntry struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+	Created    string `json:"created,omitempty"`
+	Decision   string `json:"decision"`
+	Rule       string `json:"rule,omitempty"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error,omitempty"`
+}
+
+// report collects the decisions about every examined tag. A nil report
+// ignores everything.
+type report struct {
+	mu      sync.Mutex
+	entries []reportEntry
+}
+
+func (r *report) add(b blobinfo, decision, reason string, err error) {
+	if r == nil {
+		return
+	}
+	e := reportEntry{
+		Repository: b.repo,
+		Tag:        b.tag,
+		Digest:     string(b.digest),
+		Decision:   decision,
+		Rule:       b.rule,
+		Reason:     reason,
+	}
+	if !b.created.IsZero() {
+		e.Created = b.created.Format(time.RFC3339)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+// write stores the entries sorted by repository and tag, so reports of
+// different runs can be compared with diff.
+func (r *report) write(fname, format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(r.entries, func(i, j int) bool {
+		if r.entries[i].Repository != r.entries[j].Repository {
+			return r.entries[i].Repository < r.entries[j].Repository
+		}
+		return r.entries[i].Tag < r.entries[j].Tag
+	})
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if format == "csv" {
+		w := csv.NewWriter(f)
+		w.Write([]string{"repository", "tag", "digest", "created", "decision", "rule", "reason", "error"})
+		for _, e := range r.entries {
+			w.Write([]string{e.Repository, e.Tag, e.Digest, e.Created, e.Decision, e.Rule, e.Reason, e.Error})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	entries := r.entries
+	if entries == nil {
+		entries = []reportEntry{}
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	retryMinBackoff = 500 * time.Millisecond
+	retryMaxBackoff = 30 * time.Second
+	retryMaxAfter   = 5 * time.Minute
+)
+
+// retryTransport retries idempotent requests which failed because of network
+// errors, rate limiting or a server error, with exponential backoff.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+}
+
+func newRetryTransport(base http.RoundTripper, retries int) http.RoundTripper {
+	if retries <= 0 {
+		return base
+	}
+	return &retryTransport{base: base, retries: retries}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.retries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		wait := backoff(attempt)
+		fields := log.Fields{
+			"method":  req.Method,
+			"url":     req.URL.String(),
+			"attempt": attempt + 1,
+		}
+		if err != nil {
+			fields["error"] = err
+		} else {
+			fields["status"] = resp.StatusCode
+			if after, ok := retryAfter(resp); ok {
+				wait = after
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		fields["wait"] = wait.String()
+		log.WithFields(fields).Warn("request failed, retrying")
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// shouldRetry only retries requests which can safely be sent again: GET and
+// HEAD always, DELETE only when the server says it did not process it.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case "GET", "HEAD":
+		if err != nil {
+			return true
+		}
+	case "DELETE":
+		if err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff doubles the wait time with every attempt; half of it is random, so
+// concurrent requests do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := retryMinBackoff << uint(attempt)
+	if d > retryMaxBackoff || d <= 0 {
+		d = retryMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(h); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if tm, err := http.ParseTime(h); err == nil {
+		d = tm.Sub(time.Now())
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > retryMaxAfter {
+		d = retryMaxAfter
+	}
+	return d, true
+}
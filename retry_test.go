@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingServer answers the first requests with the given status codes and
+// 200 afterwards; calls counts all requests.
+func failingServer(calls *int32, header http.Header, codes ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1))
+		if n <= len(codes) {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(codes[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func do(t *testing.T, rt http.RoundTripper, method, url string) (*http.Response, error) {
+	var body io.Reader
+	if method == "POST" || method == "PUT" {
+		body = strings.NewReader("payload")
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestRetryGetAfterServerError(t *testing.T) {
+	var calls int32
+	srv := failingServer(&calls, nil, http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	resp, err := do(t, newRetryTransport(http.DefaultTransport, 3), "GET", srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET returned %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 requests, got %d", calls)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	var calls int32
+	srv := failingServer(&calls, http.Header{"Retry-After": []string{"1"}}, http.StatusTooManyRequests)
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := do(t, newRetryTransport(http.DefaultTransport, 3), "GET", srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET returned %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %s, expected to wait for Retry-After", d)
+	}
+}
+
+func TestRetryNeverRetriesPostAndPut(t *testing.T) {
+	for _, method := range []string{"POST", "PUT"} {
+		var calls int32
+		srv := failingServer(&calls, nil, http.StatusServiceUnavailable)
+		resp, err := do(t, newRetryTransport(http.DefaultTransport, 3), method, srv.URL)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s failed: %s", method, err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s returned %d, expected %d", method, resp.StatusCode, http.StatusServiceUnavailable)
+		}
+		if calls != 1 {
+			t.Errorf("%s was sent %d times, expected once", method, calls)
+		}
+	}
+}
+
+func TestRetryDelete(t *testing.T) {
+	var calls int32
+	netErr := errors.New("connection reset by peer")
+	rt := newRetryTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, netErr
+	}), 3)
+	if _, err := do(t, rt, "DELETE", "http://registry.invalid/v2/foo/manifests/sha256:abc"); err != netErr {
+		t.Errorf("DELETE returned error %v, expected %v", err, netErr)
+	}
+	if calls != 1 {
+		t.Errorf("DELETE with network error was sent %d times, expected once", calls)
+	}
+
+	calls = 0
+	srv := failingServer(&calls, nil, http.StatusBadGateway)
+	defer srv.Close()
+	resp, err := do(t, newRetryTransport(http.DefaultTransport, 3), "DELETE", srv.URL)
+	if err != nil {
+		t.Fatalf("DELETE failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("DELETE returned %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+	if calls != 2 {
+		t.Errorf("DELETE returning 5xx was sent %d times, expected 2", calls)
+	}
+}
+
+func TestRetryBudgetExhausted(t *testing.T) {
+	var calls int32
+	srv := failingServer(&calls, nil, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout)
+	defer srv.Close()
+
+	resp, err := do(t, newRetryTransport(http.DefaultTransport, 2), "GET", srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("GET returned %d, expected the last response %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 requests, got %d", calls)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type scanResult struct {
+	name  string
+	rep   *repository
+	blobs []blobinfo
+	err   error
+}
+
+// scanRepositories queries the tags of all repositories with -concurrency
+// workers. The results are returned in the order of the repositories, so the
+// deletions which follow are done in a stable order.
+func scanRepositories(ctx context.Context, repos []string, open openFunc) []scanResult {
+	results := make([]scanResult, len(repos))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = scanRepository(ctx, repos[i], open)
+			}
+		}()
+	}
+	for i := range repos {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+func scanRepository(ctx context.Context, name string, open openFunc) scanResult {
+	log.WithFields(log.Fields{
+		"repository": name,
+	}).Info("Processing")
+	rep, err := open(ctx, name)
+	if err != nil {
+		return scanResult{name: name, err: err}
+	}
+	blobs, err := rep.getBlobInfos()
+	return scanResult{name: name, rep: rep, blobs: blobs, err: err}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	exitOK      = 0
+	exitPartial = 1
+	exitFatal   = 2
+)
+
+type repoFailure struct {
+	repo string
+	err  error
+}
+
+type summary struct {
+	repos   int
+	failed  []repoFailure
+	cache   *cache
+	limiter *rateLimitTransport
+	// reclaimable is the estimated number of bytes freed by the deletions,
+	// negative when it was not estimated
+	reclaimable int64
+	// sweptBlobs and sweptBytes were removed by the garbage collection,
+	// sweptBlobs is negative when it did not run
+	sweptBlobs int
+	sweptBytes int64
+	// purgedUploads and purgedBytes are the removed upload sessions,
+	// purgedUploads is negative when they were not purged
+	purgedUploads int
+	purgedBytes   int64
+	// dangling is the number of deleted untagged manifests, negative when
+	// they were not looked for
+	dangling int
+}
+
+func (s *summary) fail(repo string, err error) {
+	log.WithFields(log.Fields{
+		"repository": repo,
+		"error":      err,
+	}).Error("processing repository failed")
+	s.failed = append(s.failed, repoFailure{repo: repo, err: err})
+}
+
+// lookupFailures returns an error when tags of a repository could not be
+// looked up. The other tags are processed anyway, but the repository counts
+// as failed.
+func lookupFailures(blobs []blobinfo) error {
+	n := 0
+	for _, b := range blobs {
+		if b.err != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d tags could not be looked up", n)
+}
+
+// print logs the summary of the run and returns the exit code.
+func (s *summary) print() int {
+	for _, f := range s.failed {
+		log.WithFields(log.Fields{
+			"repository": f.repo,
+			"error":      f.err,
+		}).Error("failed repository")
+	}
+	fields := log.Fields{
+		"repositories": s.repos,
+		"failed":       len(s.failed),
+	}
+	if s.limiter != nil {
+		read, del := s.limiter.rates()
+		fields["readrps"] = fmt.Sprintf("%.2f", read)
+		fields["deleterps"] = fmt.Sprintf("%.2f", del)
+	}
+	if s.reclaimable >= 0 {
+		fields["reclaimable"] = humanSize(s.reclaimable)
+	}
+	if s.sweptBlobs >= 0 {
+		fields["sweptblobs"] = s.sweptBlobs
+		fields["swept"] = humanSize(s.sweptBytes)
+	}
+	if s.purgedUploads >= 0 {
+		fields["purgeduploads"] = s.purgedUploads
+		fields["purged"] = humanSize(s.purgedBytes)
+	}
+	if s.dangling >= 0 {
+		fields["danglingdeleted"] = s.dangling
+	}
+	if s.cache != nil {
+		fields["cachehits"] = s.cache.hits
+		fields["cachemisses"] = s.cache.misses
+	}
+	log.WithFields(fields).Info("summary")
+	if len(s.failed) > 0 {
+		return exitPartial
+	}
+	return exitOK
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// newTransport creates the http transport for the registry. Certificates are
+// verified unless -insecure is given; additional CAs and client certificates
+// come from the flags and the docker certs.d directory of the registry host.
+func newTransport(registryURL string) (*http.Transport, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: *insecure,
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	var cas []string
+	if *caFile != "" {
+		cas = append(cas, *caFile)
+	}
+	var pairs [][2]string
+	if *certFile != "" || *keyFile != "" {
+		if *certFile == "" || *keyFile == "" {
+			return nil, fmt.Errorf("-cert and -key must be given together")
+		}
+		pairs = append(pairs, [2]string{*certFile, *keyFile})
+	}
+
+	if *certsDir != "" {
+		dir := filepath.Join(*certsDir, registryHost(registryURL))
+		c, p, err := certsDirFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, c...)
+		pairs = append(pairs, p...)
+	}
+
+	for _, ca := range cas {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+		log.WithFields(log.Fields{
+			"file": ca,
+		}).Info("trust CA certificates")
+	}
+	cfg.RootCAs = pool
+
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p[0], p[1])
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate %s: %s", p[0], err)
+		}
+		log.WithFields(log.Fields{
+			"cert": p[0],
+			"key":  p[1],
+		}).Info("use client certificate")
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: cfg,
+	}, nil
+}
+
+// certsDirFiles returns the CA files and client certificate/key pairs of a
+// docker certs.d/<host> directory: *.crt files are CAs, *.cert files are
+// client certificates whose key is the *.key file with the same name.
+func certsDirFiles(dir string) ([]string, [][2]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	var cas []string
+	var pairs [][2]string
+	for _, fi := range fis {
+		name := fi.Name()
+		switch {
+		case strings.HasSuffix(name, ".crt"):
+			cas = append(cas, filepath.Join(dir, name))
+		case strings.HasSuffix(name, ".cert"):
+			key := strings.TrimSuffix(name, ".cert") + ".key"
+			if _, err := os.Stat(filepath.Join(dir, key)); err != nil {
+				return nil, nil, fmt.Errorf("missing key %s for client certificate %s", key, name)
+			}
+			pairs = append(pairs, [2]string{filepath.Join(dir, name), filepath.Join(dir, key)})
+		}
+	}
+	return cas, pairs, nil
+}
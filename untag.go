@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+const (
+	strategyDigest = "digest"
+	strategyUntag  = "untag"
+)
+
+type placeholderConfig struct {
+	Created      time.Time         `json:"created"`
+	Architecture string            `json:"architecture"`
+	OS           string            `json:"os"`
+	Config       placeholderLabels `json:"config"`
+	RootFS       placeholderRootFS `json:"rootfs"`
+}
+
+type placeholderLabels struct {
+	Labels map[string]string `json:"Labels"`
+}
+
+type placeholderRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// untag removes a single tag without touching the image it points to. The
+// registry API can only delete manifests by digest, so the tag is overwritten
+// with a unique placeholder manifest which is deleted afterwards. The storage
+// can remove tags directly.
+func (r *repository) untag(tag string) error {
+	if r.offline {
+		return r.tags.Untag(r.ctx, tag)
+	}
+	cfg, err := json.Marshal(placeholderConfig{
+		Created:      time.Now().UTC(),
+		Architecture: "none",
+		OS:           "none",
+		Config: placeholderLabels{Labels: map[string]string{
+			"registry-cleaner.placeholder": fmt.Sprintf("%s:%s", r.reponame, tag),
+		}},
+		RootFS: placeholderRootFS{Type: "layers", DiffIDs: []string{}},
+	})
+	if err != nil {
+		return err
+	}
+	m, err := schema2.NewManifestBuilder(r.blobs, cfg).Build(r.ctx)
+	if err != nil {
+		return fmt.Errorf("cannot build placeholder manifest: %s", err)
+	}
+	dig, err := r.manifests.Put(r.ctx, m, distribution.WithTag(tag))
+	if err != nil {
+		return fmt.Errorf("cannot push placeholder manifest: %s", err)
+	}
+	if err := r.manifests.Delete(r.ctx, dig); err != nil {
+		return fmt.Errorf("cannot delete placeholder manifest %s: %s", dig, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	dockercontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/registry/handlers"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+// newTestRegistry starts an in-process registry with inmemory storage and
+// deletes enabled.
+func newTestRegistry(t *testing.T) *httptest.Server {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+		},
+	}
+	app := handlers.NewApp(dockercontext.Background(), config)
+	return httptest.NewServer(app)
+}
+
+func openTestRepository(t *testing.T, srv *httptest.Server, name string) *repository {
+	r, err := getRepository(dockercontext.Background(), srv.URL, name, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("cannot open repository %s: %s", name, err)
+	}
+	return r
+}
+
+// pushImage pushes a schema2 image with a single layer under all given tags.
+func pushImage(t *testing.T, r *repository, created time.Time, layer string, tags ...string) digest.Digest {
+	cfg, err := json.Marshal(imageConfig{Created: &created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := r.blobs.Put(r.ctx, schema2.MediaTypeLayer, []byte(layer))
+	if err != nil {
+		t.Fatalf("cannot push layer: %s", err)
+	}
+	b := schema2.NewManifestBuilder(r.blobs, cfg)
+	if err := b.AppendReference(desc); err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Build(r.ctx)
+	if err != nil {
+		t.Fatalf("cannot build manifest: %s", err)
+	}
+	var dig digest.Digest
+	for _, tag := range tags {
+		dig, err = r.manifests.Put(r.ctx, m, distribution.WithTag(tag))
+		if err != nil {
+			t.Fatalf("cannot push manifest with tag %s: %s", tag, err)
+		}
+	}
+	return dig
+}
+
+func TestUntagKeepsImageOfOtherTags(t *testing.T) {
+	srv := newTestRegistry(t)
+	defer srv.Close()
+	lookups = make(chan struct{}, 1)
+
+	r := openTestRepository(t, srv, "app")
+	dig := pushImage(t, r, time.Now().Add(-48*time.Hour), "layer", "old-build", "stable")
+
+	blobs, err := r.getBlobInfos()
+	if err != nil {
+		t.Fatalf("cannot scan repository: %s", err)
+	}
+	if len(blobs) != 2 {
+		t.Fatalf("expected 2 tags, got %d", len(blobs))
+	}
+	maxAge := 1
+	pol := &policy{Rules: []*rule{{Name: "test", MaxAge: &maxAge, Protect: []string{"stable"}}}}
+	defer func(s string) { *strategy = s }(*strategy)
+
+	*strategy = strategyDigest
+	if dels := planDeletions(blobs, pol, time.Now()); len(dels) != 0 {
+		t.Fatalf("digest strategy planned %v, expected to leave the tag alone", describeDeletions(dels))
+	}
+
+	*strategy = strategyUntag
+	dels := planDeletions(blobs, pol, time.Now())
+	want := describeDeletions([]deletion{{digest: dig, tags: []string{"old-build"}, untag: true, reason: "untag: digest still referenced by [stable]"}})
+	if got := describeDeletions(dels); !reflect.DeepEqual(got, want) {
+		t.Fatalf("untag strategy planned %v, expected %v", got, want)
+	}
+	if err := r.deleteAll(blobs, dels); err != nil {
+		t.Fatalf("untag failed: %s", err)
+	}
+
+	tags, err := r.tags.All(r.ctx)
+	if err != nil {
+		t.Fatalf("cannot list tags: %s", err)
+	}
+	if len(tags) != 1 || tags[0] != "stable" {
+		t.Errorf("expected only tag stable to remain, got %v", tags)
+	}
+	desc, err := r.tags.Get(r.ctx, "stable")
+	if err != nil {
+		t.Fatalf("cannot resolve tag stable: %s", err)
+	}
+	if desc.Digest != dig {
+		t.Errorf("tag stable points to %s, expected %s", desc.Digest, dig)
+	}
+	if _, err := r.manifests.Get(r.ctx, dig); err != nil {
+		t.Errorf("image is no longer pullable: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/registry/storage"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// purgeUploads removes the upload sessions of interrupted pushes which were
+// started before olderThan. PurgeUploads does not tell how large the sessions
+// are, so the eligible ones are listed and measured first.
+func (s *offlineStorage) purgeUploads(ctx context.Context, olderThan time.Time, dryRun bool, sum *summary) error {
+	eligible, errs := storage.PurgeUploads(ctx, s.driver, olderThan, false)
+	if len(errs) > 0 {
+		return uploadErrors(errs)
+	}
+	sizes := make(map[string]int64)
+	for _, dir := range eligible {
+		size, err := s.dirSize(ctx, dir)
+		if err != nil {
+			return err
+		}
+		sizes[dir] = size
+	}
+	deleted := eligible
+	if !dryRun {
+		deleted, errs = storage.PurgeUploads(ctx, s.driver, olderThan, true)
+	}
+
+	sessions := make(map[string]int)
+	bytes := make(map[string]int64)
+	var repos []string
+	for _, dir := range deleted {
+		repo := uploadRepository(dir)
+		if _, ok := sessions[repo]; !ok {
+			repos = append(repos, repo)
+		}
+		sessions[repo]++
+		bytes[repo] += sizes[dir]
+	}
+	sort.Strings(repos)
+	sum.purgedUploads, sum.purgedBytes = 0, 0
+	for _, repo := range repos {
+		msg := "purged upload sessions"
+		if dryRun {
+			msg = "DRY PURGE upload sessions"
+		}
+		log.WithFields(log.Fields{
+			"repository": repo,
+			"sessions":   sessions[repo],
+			"bytes":      bytes[repo],
+			"size":       humanSize(bytes[repo]),
+		}).Info(msg)
+		sum.purgedUploads += sessions[repo]
+		sum.purgedBytes += bytes[repo]
+	}
+	if len(errs) > 0 {
+		return uploadErrors(errs)
+	}
+	return nil
+}
+
+func (s *offlineStorage) dirSize(ctx context.Context, dir string) (int64, error) {
+	var size int64
+	err := storage.Walk(ctx, s.driver, dir, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// uploadRepository returns the repository of an upload directory like
+// /docker/registry/v2/repositories/<name>/_uploads/<id>.
+func uploadRepository(dir string) string {
+	repo := path.Dir(path.Dir(dir))
+	return strings.TrimPrefix(repo, repositoriesRoot)
+}
+
+func uploadErrors(errs []error) error {
+	for _, e := range errs {
+		log.WithFields(log.Fields{
+			"error": e,
+		}).Error("cannot purge upload session")
+	}
+	return fmt.Errorf("%d upload sessions could not be purged", len(errs))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+)
+
+// brokenImage is a tagged manifest which can never be pulled because a
+// manifest or blob it references is missing.
+type brokenImage struct {
+	digest  digest.Digest
+	tags    []string
+	missing []digest.Digest
+}
+
+// verifyRepositories checks that every blob referenced by a tag exists. With
+// -delete-broken the manifests of broken images are deleted; repositories
+// with broken images which are left count as failed.
+func verifyRepositories(ctx context.Context, repos []string, open openFunc, sum *summary) {
+	for _, name := range repos {
+		log.WithFields(log.Fields{
+			"repository": name,
+		}).Info("Verifying")
+		r, err := open(ctx, name)
+		if err != nil {
+			sum.fail(name, err)
+			continue
+		}
+		if err := r.verify(); err != nil {
+			sum.fail(name, err)
+		}
+	}
+}
+
+func (r *repository) verify() error {
+	all, err := r.tags.All(r.ctx)
+	if err != nil {
+		return err
+	}
+	var broken []*brokenImage
+	byDigest := make(map[digest.Digest]*brokenImage)
+	checked := make(map[digest.Digest][]digest.Digest)
+	for _, t := range all {
+		desc, err := r.tags.Get(r.ctx, t)
+		if err != nil {
+			return fmt.Errorf("cannot query tag %s: %s", t, err)
+		}
+		missing, ok := checked[desc.Digest]
+		if !ok {
+			if missing, err = r.missingBlobs(desc.Digest); err != nil {
+				return fmt.Errorf("cannot verify tag %s: %s", t, err)
+			}
+			checked[desc.Digest] = missing
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		b := byDigest[desc.Digest]
+		if b == nil {
+			b = &brokenImage{digest: desc.Digest, missing: missing}
+			byDigest[desc.Digest] = b
+			broken = append(broken, b)
+		}
+		b.tags = append(b.tags, t)
+	}
+
+	failed := 0
+	for _, b := range broken {
+		log.WithFields(log.Fields{
+			"repository": r.reponame,
+			"digest":     b.digest,
+			"tags":       b.tags,
+			"missing":    b.missing,
+		}).Warn("broken image")
+		reason := fmt.Sprintf("broken, %d blobs missing", len(b.missing))
+		if !*deleteBroken {
+			r.reportBroken(b, decisionKept, reason, nil)
+			failed++
+			continue
+		}
+		e := r.deleteDigest(b.digest, b.tags)
+		switch {
+		case e != nil:
+			r.reportBroken(b, decisionError, "delete failed", e)
+			failed++
+		case *dry:
+			r.reportBroken(b, decisionSkipped, "dry run, would delete "+reason, nil)
+		default:
+			r.reportBroken(b, decisionDeleted, reason, nil)
+		}
+	}
+	log.WithFields(log.Fields{
+		"repository": r.reponame,
+		"tags":       len(all),
+		"broken":     len(broken),
+	}).Info("verified repository")
+	if failed > 0 {
+		return fmt.Errorf("%d broken images", failed)
+	}
+	return nil
+}
+
+func (r *repository) reportBroken(b *brokenImage, decision, reason string, err error) {
+	for _, t := range b.tags {
+		cleanupReport.add(blobinfo{repo: r.reponame, tag: t, digest: b.digest}, decision, reason, err)
+	}
+}
+
+// missingBlobs returns the manifests and blobs referenced by the manifest
+// which do not exist, including the manifest itself. Other errors, like an
+// unreachable registry, are returned and do not make the image broken.
+func (r *repository) missingBlobs(dig digest.Digest) ([]digest.Digest, error) {
+	mf, err := r.manifests.Get(r.ctx, dig)
+	if isUnknown(err) {
+		return []digest.Digest{dig}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var missing []digest.Digest
+	if ml, ok := mf.(*manifestlist.DeserializedManifestList); ok {
+		for _, m := range ml.Manifests {
+			mm, err := r.missingBlobs(m.Digest)
+			if err != nil {
+				return nil, err
+			}
+			missing = append(missing, mm...)
+		}
+		return missing, nil
+	}
+	refs := mf.References()
+	if m, ok := mf.(*schema2.DeserializedManifest); ok {
+		refs = append([]distribution.Descriptor{m.Config}, refs...)
+	}
+	for _, d := range refs {
+		_, err := r.blobs.Stat(r.ctx, d.Digest)
+		if isUnknown(err) {
+			missing = append(missing, d.Digest)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat blob %s: %s", d.Digest, err)
+		}
+	}
+	return missing, nil
+}
+
+// isUnknown tells whether the storage or the registry API reports a manifest
+// or blob as missing.
+func isUnknown(err error) bool {
+	switch e := err.(type) {
+	case distribution.ErrManifestUnknown, distribution.ErrManifestUnknownRevision:
+		return true
+	case errcode.Errors:
+		for _, ee := range e {
+			if isUnknown(ee) {
+				return true
+			}
+		}
+	case errcode.Error:
+		switch e.Code {
+		case v2.ErrorCodeManifestUnknown, v2.ErrorCodeBlobUnknown, v2.ErrorCodeManifestBlobUnknown:
+			return true
+		}
+	}
+	return err == distribution.ErrBlobUnknown
+}